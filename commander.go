@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 // Show the help message for commander
@@ -14,11 +15,27 @@ func ShowHelp() {
 	fmt.Println(datamodels.HELP_MSG)
 }
 
+// Show the analyses generated for the experiment of a param file.
+func ListAnalyses(paramFile string) error {
+	var job datamodels.Job
+	var err error
+
+	if utils.IsJSONParam(paramFile) {
+		job, err = utils.ParseJSONParams(paramFile)
+	} else {
+		job, err = utils.ParsePlainTextParams(paramFile)
+	}
+	if err != nil {
+		return err
+	}
+	return utils.ListAnalyses(job.ExperimentDetails)
+}
+
 func main() {
 	var err error
 	var job datamodels.Job
 	var platform string
-	var sge, slurm, submit, preflight bool
+	var sge, slurm, submit, preflight, resume bool
 
 	// Declare command line flags.
 	flag.Bool("help", false, "Show help message")
@@ -26,6 +43,16 @@ func main() {
 	flag.Bool("preflight", false, "Run all preflight tests")
 	flag.Bool("slurm", false, "Generate scripts for a Slurm cluster")
 	flag.Bool("sge", false, "Generate scripts for a SGE cluster")
+	flag.Bool("resume", false, "Skip steps that already completed")
+	flag.String("force-step", "", "Comma separated list of steps to rerun when resuming")
+	flag.Bool("dry-run", false, "Show what would be written without touching the filesystem")
+	flag.String("outdir", "", "Directory to write the generated scripts to")
+	flag.Bool("verify-checksums", false, "Verify sample files against their checksums during preflight")
+	flag.String("fastq-check", "off", "Check FASTQ content during preflight: off, quick or full")
+	flag.String("preflight-json", "", "Write the preflight report as JSON to this file")
+	flag.String("preflight-junit", "", "Write the preflight report as JUnit XML to this file")
+	flag.Bool("overwrite", false, "Allow existing analysis output to be overwritten")
+	flag.Bool("increment-analysis-id", false, "Use the next free analysis ID if the analysis already has output")
 	flag.Parse()
 
 	/* -------------------------------------------------------------------------
@@ -37,6 +64,53 @@ func main() {
 		os.Exit(1)
 	}
 
+	/* -------------------------------------------------------------------------
+	 * Check for the list subcommand. It only needs the param file.
+	 * ---------------------------------------------------------------------- */
+	if len(flag.Args()) > 0 && flag.Args()[0] == "list" {
+		if len(flag.Args()) != 2 {
+			log.Fatal("Error: Wrong number of args. \nExpecting: commander list <path_to_param_file.json>")
+		}
+		err = ListAnalyses(flag.Args()[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	/* -------------------------------------------------------------------------
+	 * Check for the package subcommand. It only needs a finished analysis.
+	 * ---------------------------------------------------------------------- */
+	if len(flag.Args()) > 0 && flag.Args()[0] == "package" {
+		if len(flag.Args()) != 2 {
+			log.Fatal("Error: Wrong number of args. \nExpecting: commander package <path_to_analysis_dir>")
+		}
+		err = utils.PackageAnalysis(flag.Args()[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	/* -------------------------------------------------------------------------
+	 * Check for the tune subcommand. It reads accounting data of earlier
+	 * analyses and takes its own flags after the subcommand name.
+	 * ---------------------------------------------------------------------- */
+	if len(flag.Args()) > 0 && flag.Args()[0] == "tune" {
+		tuneFlags := flag.NewFlagSet("tune", flag.ExitOnError)
+		tuneFlags.String("write", "", "Write a copy of the param file with the recommended resources to this file")
+		tuneFlags.Parse(flag.Args()[1:])
+		if len(tuneFlags.Args()) < 1 {
+			log.Fatal("Error: Wrong number of args. \nExpecting: commander tune [--write <new_param_file.json>] <path_to_param_file.json> [<path_to_analysis_dir>...]")
+		}
+		writeFile := tuneFlags.Lookup("write").Value.String()
+		err = utils.TuneAnalyses(tuneFlags.Args()[0], tuneFlags.Args()[1:], writeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	/* -------------------------------------------------------------------------
 	 * Check for the submit flag
 	 * ---------------------------------------------------------------------- */
@@ -77,6 +151,72 @@ func main() {
 		preflight = true
 	}
 
+	/* -------------------------------------------------------------------------
+	 * Check for the resume flag and any steps that should be forced to rerun.
+	 * ---------------------------------------------------------------------- */
+	resumeFlag := flag.Lookup("resume")
+	if resumeFlag.Value.String() == "true" {
+		resume = true
+	}
+
+	forceStepFlag := flag.Lookup("force-step")
+	if forceStepFlag.Value.String() != "" {
+		if !resume {
+			log.Fatal("Error: --force-step only applies when resuming. Use it together with --resume.")
+		}
+		utils.ForceSteps = strings.Split(forceStepFlag.Value.String(), ",")
+	}
+
+	/* -------------------------------------------------------------------------
+	 * Check for the dry-run flag
+	 * ---------------------------------------------------------------------- */
+	dryRunFlag := flag.Lookup("dry-run")
+	if dryRunFlag.Value.String() == "true" {
+		utils.DryRun = true
+	}
+
+	/* -------------------------------------------------------------------------
+	 * Check for the verify-checksums flag
+	 * ---------------------------------------------------------------------- */
+	verifyFlag := flag.Lookup("verify-checksums")
+	if verifyFlag.Value.String() == "true" {
+		utils.VerifyChecksums = true
+	}
+
+	/* -------------------------------------------------------------------------
+	 * Check for the fastq-check level
+	 * ---------------------------------------------------------------------- */
+	fastqCheckFlag := flag.Lookup("fastq-check")
+	if !utils.IsFastqCheckLevel(fastqCheckFlag.Value.String()) {
+		log.Fatal(fmt.Sprintf("Error: Unknown --fastq-check level \"%s\". Expecting off, quick or full.", fastqCheckFlag.Value.String()))
+	}
+	utils.FastqCheck = fastqCheckFlag.Value.String()
+
+	/* -------------------------------------------------------------------------
+	 * Check for the preflight report files
+	 * ---------------------------------------------------------------------- */
+	utils.PreflightJSON = flag.Lookup("preflight-json").Value.String()
+	utils.PreflightJUnit = flag.Lookup("preflight-junit").Value.String()
+
+	/* -------------------------------------------------------------------------
+	 * Check for the flags that decide what happens to existing output.
+	 * ---------------------------------------------------------------------- */
+	overwriteFlag := flag.Lookup("overwrite")
+	if overwriteFlag.Value.String() == "true" {
+		utils.Overwrite = true
+	}
+
+	incrementFlag := flag.Lookup("increment-analysis-id")
+	if incrementFlag.Value.String() == "true" {
+		utils.IncrementAnalysisID = true
+	}
+
+	/* -------------------------------------------------------------------------
+	 * Check for the output directory of the generated scripts.
+	 * ---------------------------------------------------------------------- */
+	outDirFlag := flag.Lookup("outdir")
+	utils.OutDir = outDirFlag.Value.String()
+
 	/* -------------------------------------------------------------------------
 	 * Get the param file from the command line. It should be the only elem in
 	 * flag.Args()
@@ -94,8 +234,9 @@ func main() {
 	 * We are supporting both plain text and json param files.
 	 * ---------------------------------------------------------------------- */
 
-	// Set the platform variable in the utils package.
+	// Set the platform and resume variables in the utils package.
 	utils.Platform = platform
+	utils.Resume = resume
 
 	// Create the primary job object.
 	if utils.IsJSONParam(paramFile) {
@@ -112,6 +253,11 @@ func main() {
 		}
 	}
 
+	// Only Slurm can chain separately submitted jobs.
+	if job.Details.IsSeparateSubmission() && !slurm {
+		log.Fatal(`Error: submission_mode "separate" is only supported with --slurm`)
+	}
+
 	// Initialize experiment sample objects.
 	if job.ExperimentDetails.SamplesFile != "" {
 		samples := utils.ParseSamplesFile(job.ExperimentDetails.SamplesFile)
@@ -122,8 +268,53 @@ func main() {
 		job.ExperimentDetails.InitializePaths()
 	}
 
+	// Settle the analysis ID before any paths are built from it.
+	err = utils.AssignAnalysisID(&job, paramFile)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Check the pipeline steps form a valid graph before resolving any paths.
+	if _, err = job.BuildDAG(); err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Move to a fresh analysis ID if asked to.
+	err = utils.NextFreeAnalysisID(&job.ExperimentDetails)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Settle where the generated scripts are written.
+	err = utils.ResolveOutDir(job.ExperimentDetails)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
 	// Initialize all input and output paths for the commands.
-	job.InitializeCMDIOPaths()
+	err = job.InitializeCMDIOPaths()
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Work out which samples each step runs for.
+	err = utils.PlanConditions(job)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Work out which steps already completed when resuming.
+	err = utils.PlanResume(job)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
 
 	// Perform preflight experiment path checks.
 	if preflight {
@@ -138,6 +329,13 @@ func main() {
 			os.Exit(1)
 		}
 
+		// Record the container images preflight resolved.
+		err = utils.ArchiveResolvedImages(job.ExperimentDetails)
+		if err != nil {
+			log.Fatal(err)
+			os.Exit(1)
+		}
+
 		// Archive the design file if one is given.
 		if job.ExperimentDetails.SamplesFile != "" {
 			_, err = utils.ArchiveDesignFile(job.ExperimentDetails)
@@ -167,7 +365,25 @@ func main() {
 		fmt.Println("Done.")
 	}
 
-	if submit {
+	// Record how the analysis was generated.
+	err = utils.WriteManifest(job, paramFile)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	// Record the analysis in the experiment's index.
+	err = utils.RecordAnalysisID(job.ExperimentDetails, paramFile)
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
+
+	utils.PrintGenerationSummary()
+
+	if utils.DryRun {
+		fmt.Printf("[dry-run] Would submit the job with: %s\n", utils.SubmitCommand(job))
+	} else if submit {
 		fmt.Println("submit")
 	}
 }
@@ -0,0 +1,179 @@
+package datamodels
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* -----------------------------------------------------------------------------
+ * Tool adapters describe how commander hands shared resources, like a
+ * reference index, to a specific tool, and how much output the tool writes.
+ * -------------------------------------------------------------------------- */
+
+type ToolAdapter struct {
+	// Key of the tool's index in the "indexes" block of a reference.
+	IndexName string
+	// Option the index is passed with. Empty when the index is positional.
+	IndexFlag string
+	// Whether the index is a directory rather than a file or file prefix.
+	IndexIsDir bool
+	// Files that make up the index. For directories these are names inside
+	// the directory. Otherwise they are suffixes appended to the index path.
+	IndexFiles []string
+	// Files of the large index variant, which stand in for IndexFiles when
+	// present, e.g. the .ht2l files hisat2 builds for big genomes.
+	LargeIndexFiles []string
+	// Output size of a sample relative to the size of its raw read files.
+	OutputMultiplier float64
+	// Number of files written per sample.
+	FilesPerSample int
+}
+
+// Output estimate for tools without an adapter.
+const DEFAULT_OUTPUT_MULTIPLIER = 1.0
+const DEFAULT_FILES_PER_SAMPLE = 5
+
+var TOOL_ADAPTERS = map[string]ToolAdapter{
+	"STAR": {
+		IndexName:  "star",
+		IndexFlag:  "--genomeDir",
+		IndexIsDir: true,
+		IndexFiles: []string{"Genome", "SA", "SAindex"},
+		// Unsorted BAM plus logs and splice junctions.
+		OutputMultiplier: 1.5,
+		FilesPerSample:   6,
+	},
+	"hisat2": {
+		IndexName:        "hisat2",
+		IndexFlag:        "-x",
+		IndexFiles:       []string{".1.ht2"},
+		LargeIndexFiles:  []string{".1.ht2l"},
+		OutputMultiplier: 1.5,
+		FilesPerSample:   2,
+	},
+	// Only quant takes the index as -i. index writes it and inspect takes it
+	// as an argument.
+	"kallisto quant": {
+		IndexName:        "kallisto",
+		IndexFlag:        "-i",
+		IndexFiles:       []string{""},
+		OutputMultiplier: 0.01,
+		FilesPerSample:   3,
+	},
+	"salmon": {
+		IndexName:        "salmon",
+		IndexFlag:        "-i",
+		IndexIsDir:       true,
+		IndexFiles:       []string{"versionInfo.json"},
+		OutputMultiplier: 0.01,
+		FilesPerSample:   20,
+	},
+	"rsem-calculate-expression": {
+		IndexName:  "rsem",
+		IndexFiles: []string{".grp", ".ti", ".seq"},
+		// Transcript and genome BAMs.
+		OutputMultiplier: 3.0,
+		FilesPerSample:   8,
+	},
+	"trim_galore": {
+		OutputMultiplier: 1.0,
+		FilesPerSample:   4,
+	},
+	"fastqc": {
+		OutputMultiplier: 0.05,
+		FilesPerSample:   4,
+	},
+	"samtools index": {
+		OutputMultiplier: 0.01,
+		FilesPerSample:   1,
+	},
+	"samtools sort": {
+		OutputMultiplier: 1.0,
+		FilesPerSample:   1,
+	},
+}
+
+/* ---
+ * Return the adapter for the tool a command runs, if commander knows it. An
+ * adapter for the command and subcommand wins over one for the command.
+ * --- */
+func AdapterFor(cmd Command) (ToolAdapter, bool) {
+	if cmd.SubCommandName() != "" {
+		if adapter, ok := TOOL_ADAPTERS[fmt.Sprintf("%s %s", cmd.CommandName(), cmd.SubCommandName())]; ok {
+			return adapter, ok
+		}
+	}
+	adapter, ok := TOOL_ADAPTERS[cmd.CommandName()]
+	return adapter, ok
+}
+
+/* ---
+ * Return the output multiplier and files per sample of a command, falling back
+ * to the defaults for tools without an adapter.
+ * --- */
+func OutputEstimate(cmd Command) (float64, int) {
+	adapter, ok := AdapterFor(cmd)
+	if !ok || adapter.OutputMultiplier == 0 {
+		return DEFAULT_OUTPUT_MULTIPLIER, DEFAULT_FILES_PER_SAMPLE
+	}
+	return adapter.OutputMultiplier, adapter.FilesPerSample
+}
+
+/* ---
+ * Return the paths of the files that make up an index. Each set of paths is a
+ * complete index, the regular one first.
+ * --- */
+func (a *ToolAdapter) IndexFileSets(index string) [][]string {
+	var sets = [][]string{a.indexFilePaths(index, a.IndexFiles)}
+	if len(a.LargeIndexFiles) > 0 {
+		sets = append(sets, a.indexFilePaths(index, a.LargeIndexFiles))
+	}
+	return sets
+}
+
+func (a *ToolAdapter) indexFilePaths(index string, files []string) []string {
+	var paths = make([]string, 0)
+	for _, f := range files {
+		if a.IndexIsDir {
+			paths = append(paths, fmt.Sprintf("%s/%s", index, f))
+		} else {
+			paths = append(paths, fmt.Sprintf("%s%s", index, f))
+		}
+	}
+	return paths
+}
+
+/* ---
+ * Return the host directory that must be mounted for the index to be read.
+ * --- */
+func (a *ToolAdapter) IndexMountPath(index string) string {
+	if a.IndexIsDir {
+		return index
+	}
+	chunks := strings.Split(index, "/")
+	if len(chunks) == 1 {
+		return "."
+	}
+	return strings.Join(chunks[:len(chunks)-1], "/")
+}
+
+/* ---
+ * Add the index to a command's options or arguments. An option already
+ * passing the index flag is replaced. Positional indexes are appended to the
+ * arguments.
+ * --- */
+func (a *ToolAdapter) InsertIndex(params *CommandParams, index string) {
+	if a.IndexFlag == "" {
+		params.CommandArgs = append(params.CommandArgs, index)
+		return
+	}
+
+	option := fmt.Sprintf("%s %s", a.IndexFlag, index)
+	for i, opt := range params.CommandOptions {
+		if strings.Split(opt, " ")[0] == a.IndexFlag {
+			params.CommandOptions[i] = option
+			return
+		}
+	}
+	params.CommandOptions = append(params.CommandOptions, option)
+}
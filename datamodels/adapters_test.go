@@ -0,0 +1,60 @@
+package datamodels
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdapterFor(t *testing.T) {
+	var tests = []struct {
+		command    string
+		subcommand string
+		index      string
+		ok         bool
+	}{
+		{"STAR", "", "star", true},
+		{"hisat2", "", "hisat2", true},
+		{"kallisto", "quant", "kallisto", true},
+		{"kallisto", "index", "", false},
+		{"kallisto", "inspect", "", false},
+		{"samtools", "index", "", true},
+		{"bwa", "mem", "", false},
+	}
+
+	for _, tt := range tests {
+		cmd := Command{CommandParams: CommandParams{Command: tt.command, Subcommand: tt.subcommand}}
+		adapter, ok := AdapterFor(cmd)
+		if ok != tt.ok || adapter.IndexName != tt.index {
+			t.Errorf("AdapterFor(%s %s) = %q, %t, want %q, %t", tt.command, tt.subcommand, adapter.IndexName, ok, tt.index, tt.ok)
+		}
+	}
+}
+
+func TestIndexFileSets(t *testing.T) {
+	var tests = []struct {
+		tool  string
+		index string
+		sets  [][]string
+	}{
+		{"hisat2", "/ref/hg38", [][]string{{"/ref/hg38.1.ht2"}, {"/ref/hg38.1.ht2l"}}},
+		{"STAR", "/ref/star", [][]string{{"/ref/star/Genome", "/ref/star/SA", "/ref/star/SAindex"}}},
+		{"kallisto quant", "/ref/hg38.idx", [][]string{{"/ref/hg38.idx"}}},
+	}
+
+	for _, tt := range tests {
+		adapter := TOOL_ADAPTERS[tt.tool]
+		if sets := adapter.IndexFileSets(tt.index); !reflect.DeepEqual(sets, tt.sets) {
+			t.Errorf("IndexFileSets(%s) for %s = %v, want %v", tt.index, tt.tool, sets, tt.sets)
+		}
+	}
+}
+
+func TestInsertIndex(t *testing.T) {
+	adapter := TOOL_ADAPTERS["kallisto quant"]
+	params := CommandParams{CommandOptions: []string{"-i old.idx", "-o out"}}
+	adapter.InsertIndex(&params, "/ref/hg38.idx")
+	want := []string{"-i /ref/hg38.idx", "-o out"}
+	if !reflect.DeepEqual(params.CommandOptions, want) {
+		t.Errorf("options = %v, want %v", params.CommandOptions, want)
+	}
+}
@@ -0,0 +1,98 @@
+package datamodels
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A description of the partitions of a Slurm cluster. Limits are per node. A
+// limit of zero means unlimited.
+type Cluster struct {
+	Partitions []Partition
+}
+
+type Partition struct {
+	Name      string   `json:"name"`
+	Default   bool     `json:"default,omitempty"`
+	MaxCPUs   int64    `json:"max_cpus"`
+	MaxMemory Memory   `json:"max_memory"`
+	MaxTime   WallTime `json:"max_time"`
+	Nodes     []string `json:"nodes,omitempty"`
+}
+
+// Time limits Slurm writes for partitions without one.
+var UNLIMITED_TIMES = []string{"", "UNLIMITED", "infinite", "n/a"}
+
+/* ---
+ * Return the partition with the given name.
+ * --- */
+func (c *Cluster) Partition(name string) (Partition, bool) {
+	for _, p := range c.Partitions {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+/* ---
+ * Return the names of all partitions.
+ * --- */
+func (c *Cluster) PartitionNames() []string {
+	var names = make([]string, 0)
+	for _, p := range c.Partitions {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+/* ---
+ * Return the smallest partition that fits a request, going by CPUs, then
+ * memory, then time. Unlimited partitions sort last.
+ * --- */
+func (c *Cluster) SmallestFit(cpus int64, memory Memory, wallTime WallTime) (Partition, bool) {
+	var fits = make([]Partition, 0)
+	for _, p := range c.Partitions {
+		if len(p.Exceeds(cpus, memory, wallTime)) == 0 {
+			fits = append(fits, p)
+		}
+	}
+	if len(fits) == 0 {
+		return Partition{}, false
+	}
+
+	limit := func(v int64) int64 {
+		if v == 0 {
+			return int64(^uint64(0) >> 1)
+		}
+		return v
+	}
+	sort.SliceStable(fits, func(i, j int) bool {
+		if limit(fits[i].MaxCPUs) != limit(fits[j].MaxCPUs) {
+			return limit(fits[i].MaxCPUs) < limit(fits[j].MaxCPUs)
+		}
+		if limit(int64(fits[i].MaxMemory)) != limit(int64(fits[j].MaxMemory)) {
+			return limit(int64(fits[i].MaxMemory)) < limit(int64(fits[j].MaxMemory))
+		}
+		return limit(int64(fits[i].MaxTime)) < limit(int64(fits[j].MaxTime))
+	})
+	return fits[0], true
+}
+
+/* ---
+ * Return a description of every limit of the partition a request exceeds.
+ * A zero request is not checked.
+ * --- */
+func (p *Partition) Exceeds(cpus int64, memory Memory, wallTime WallTime) []string {
+	var exceeded = make([]string, 0)
+	if p.MaxCPUs > 0 && cpus > p.MaxCPUs {
+		exceeded = append(exceeded, fmt.Sprintf("%d CPUs requested but partition %s has at most %d per node", cpus, p.Name, p.MaxCPUs))
+	}
+	if p.MaxMemory > 0 && memory > p.MaxMemory {
+		exceeded = append(exceeded, fmt.Sprintf("%s memory requested but partition %s has at most %s per node", memory, p.Name, p.MaxMemory))
+	}
+	if p.MaxTime > 0 && wallTime > p.MaxTime {
+		exceeded = append(exceeded, fmt.Sprintf("%s wall time requested but partition %s allows at most %s", wallTime, p.Name, p.MaxTime))
+	}
+	return exceeded
+}
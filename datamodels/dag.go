@@ -0,0 +1,202 @@
+package datamodels
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Separator between a step ID and one of its named outputs in an input
+// reference, e.g. "STAR:bam".
+const OUTPUT_REF_SEPARATOR = ":"
+
+// Characters a step ID can't hold. IDs end up in input references, script
+// names and output paths.
+const INVALID_STEP_ID_CHARS = OUTPUT_REF_SEPARATOR + "/ \t\n\r"
+
+/* -----------------------------------------------------------------------------
+ * Step references.
+ * -------------------------------------------------------------------------- */
+
+type StepRef struct {
+	StepID string
+	Output string
+}
+
+func ParseStepRef(ref string) StepRef {
+	chunks := strings.SplitN(ref, OUTPUT_REF_SEPARATOR, 2)
+	if len(chunks) == 1 {
+		return StepRef{StepID: chunks[0]}
+	}
+	return StepRef{StepID: chunks[0], Output: chunks[1]}
+}
+
+/* ---
+ * Check that a step ID can be used in input references and file names.
+ * --- */
+func ValidateStepID(id string) error {
+	if id == "" {
+		return fmt.Errorf("pipeline error: empty step id")
+	}
+	if strings.ContainsAny(id, INVALID_STEP_ID_CHARS) {
+		return fmt.Errorf(`pipeline error: step id "%s" can't contain "%s", "/" or whitespace`, id, OUTPUT_REF_SEPARATOR)
+	}
+	return nil
+}
+
+func (r *StepRef) String() string {
+	if r.Output == "" {
+		return r.StepID
+	}
+	return fmt.Sprintf("%s%s%s", r.StepID, OUTPUT_REF_SEPARATOR, r.Output)
+}
+
+/* -----------------------------------------------------------------------------
+ * The step graph.
+ * -------------------------------------------------------------------------- */
+
+type StepDAG struct {
+	// Step IDs in declaration order.
+	Steps []string
+	// Step IDs each step takes input from.
+	Parents map[string][]string
+	// Step IDs that take input from each step.
+	Children map[string][]string
+	// Index of each step in Job.Commands.
+	Index map[string]int
+}
+
+/* ---
+ * Build the step graph for the job. Reports invalid or duplicate step IDs,
+ * references to unknown steps or unknown named outputs, and cycles.
+ * --- */
+func (j *Job) BuildDAG() (StepDAG, error) {
+	var dag = StepDAG{
+		Steps:    make([]string, 0),
+		Parents:  make(map[string][]string),
+		Children: make(map[string][]string),
+		Index:    make(map[string]int),
+	}
+
+	for i := range j.Commands {
+		id := j.Commands[i].StepID()
+		if err := ValidateStepID(id); err != nil {
+			return dag, err
+		}
+		if _, ok := dag.Index[id]; ok {
+			return dag, fmt.Errorf(`pipeline error: duplicate step id "%s"`, id)
+		}
+		dag.Index[id] = i
+		dag.Steps = append(dag.Steps, id)
+	}
+
+	for i := range j.Commands {
+		cmd := j.Commands[i]
+		id := cmd.StepID()
+		for _, input := range cmd.Inputs {
+			ref := ParseStepRef(input)
+			parentIndex, ok := dag.Index[ref.StepID]
+			if !ok {
+				return dag, fmt.Errorf(`pipeline error: step "%s" takes input from unknown step "%s"`, id, ref.StepID)
+			}
+			if ref.Output != "" {
+				if _, ok := j.Commands[parentIndex].Outputs[ref.Output]; !ok {
+					return dag, fmt.Errorf(`pipeline error: step "%s" takes input "%s" but step "%s" has no output named "%s"`, id, input, ref.StepID, ref.Output)
+				}
+			}
+			if ref.StepID == id {
+				return dag, fmt.Errorf(`pipeline error: step "%s" takes input from itself`, id)
+			}
+			if !containsString(dag.Parents[id], ref.StepID) {
+				dag.Parents[id] = append(dag.Parents[id], ref.StepID)
+				dag.Children[ref.StepID] = append(dag.Children[ref.StepID], id)
+			}
+		}
+	}
+
+	_, err := dag.Levels()
+	return dag, err
+}
+
+/* ---
+ * Group the steps into levels. Every step only depends on steps in earlier
+ * levels, so the steps within a level can run in parallel. Steps keep their
+ * declaration order within a level.
+ * --- */
+func (d *StepDAG) Levels() ([][]string, error) {
+	var levels = make([][]string, 0)
+	var remaining = make(map[string]int)
+	var scheduled = 0
+
+	for _, id := range d.Steps {
+		remaining[id] = len(d.Parents[id])
+	}
+
+	for scheduled < len(d.Steps) {
+		var level = make([]string, 0)
+		for _, id := range d.Steps {
+			if remaining[id] == 0 {
+				level = append(level, id)
+			}
+		}
+
+		if len(level) == 0 {
+			// Everything left waits on something else left. That is a cycle.
+			var cycle = make([]string, 0)
+			for id, n := range remaining {
+				if n > 0 {
+					cycle = append(cycle, id)
+				}
+			}
+			sort.Strings(cycle)
+			return levels, fmt.Errorf("pipeline error: cycle detected between steps %s", strings.Join(cycle, ", "))
+		}
+
+		for _, id := range level {
+			// Mark the step as scheduled and release its children.
+			remaining[id] = -1
+			for _, child := range d.Children[id] {
+				remaining[child]--
+			}
+		}
+		scheduled += len(level)
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+/* ---
+ * Return the topological schedule of the job as levels of commands. This is
+ * the order every backend writes steps in.
+ * --- */
+func (j *Job) Schedule() ([][]Command, error) {
+	var schedule = make([][]Command, 0)
+
+	dag, err := j.BuildDAG()
+	if err != nil {
+		return schedule, err
+	}
+
+	levels, err := dag.Levels()
+	if err != nil {
+		return schedule, err
+	}
+
+	for _, level := range levels {
+		var cmds = make([]Command, 0)
+		for _, id := range level {
+			cmds = append(cmds, j.Commands[dag.Index[id]])
+		}
+		schedule = append(schedule, cmds)
+	}
+	return schedule, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package datamodels
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func step(id string, inputs ...string) Command {
+	return Command{ID: id, Inputs: inputs, CommandParams: CommandParams{Command: id}}
+}
+
+func TestBuildDAG(t *testing.T) {
+	var tests = []struct {
+		name     string
+		commands []Command
+		levels   [][]string
+		err      string
+	}{
+		{
+			name:     "linear",
+			commands: []Command{step("trim"), step("align", "trim"), step("index", "align")},
+			levels:   [][]string{{"trim"}, {"align"}, {"index"}},
+		},
+		{
+			name:     "fan out and in",
+			commands: []Command{step("trim"), step("fastqc", "trim"), step("align", "trim"), step("report", "fastqc", "align")},
+			levels:   [][]string{{"trim"}, {"fastqc", "align"}, {"report"}},
+		},
+		{
+			name:     "duplicate id",
+			commands: []Command{step("trim"), step("trim")},
+			err:      `duplicate step id "trim"`,
+		},
+		{
+			name:     "unknown step",
+			commands: []Command{step("trim"), step("align", "trimm")},
+			err:      `unknown step "trimm"`,
+		},
+		{
+			name:     "unknown output",
+			commands: []Command{step("trim"), step("align", "trim:reads")},
+			err:      `has no output named "reads"`,
+		},
+		{
+			name:     "input from itself",
+			commands: []Command{step("trim", "trim")},
+			err:      "takes input from itself",
+		},
+		{
+			name:     "cycle",
+			commands: []Command{step("trim"), step("a", "trim", "b"), step("b", "a")},
+			err:      "cycle detected between steps a, b",
+		},
+		{
+			name:     "id with separator",
+			commands: []Command{step("trim:1")},
+			err:      `step id "trim:1"`,
+		},
+		{
+			name:     "id with slash",
+			commands: []Command{step("trim/1")},
+			err:      `step id "trim/1"`,
+		},
+		{
+			name:     "id with whitespace",
+			commands: []Command{step("trim 1")},
+			err:      `step id "trim 1"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := Job{Commands: tt.commands}
+			dag, err := job.BuildDAG()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("BuildDAG() error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildDAG() error = %v", err)
+			}
+			levels, err := dag.Levels()
+			if err != nil {
+				t.Fatalf("Levels() error = %v", err)
+			}
+			if !reflect.DeepEqual(levels, tt.levels) {
+				t.Errorf("Levels() = %v, want %v", levels, tt.levels)
+			}
+		})
+	}
+}
+
+func TestValidateStepID(t *testing.T) {
+	var tests = []struct {
+		id    string
+		valid bool
+	}{
+		{"STAR", true},
+		{"samtools_index_2", true},
+		{"trim-galore.v2", true},
+		{"", false},
+		{"STAR:bam", false},
+		{"STAR/bam", false},
+		{"STAR bam", false},
+		{"STAR\tbam", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateStepID(tt.id)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateStepID(%q) error = %v, want valid %v", tt.id, err, tt.valid)
+		}
+	}
+}
+
+func TestAssignStepNames(t *testing.T) {
+	var commands = []Command{
+		{CommandParams: CommandParams{Command: "STAR"}},
+		{CommandParams: CommandParams{Command: "samtools", Subcommand: "index"}, Inputs: []string{"STAR"}},
+		{CommandParams: CommandParams{Command: "STAR"}},
+		{ID: "STAR_3", CommandParams: CommandParams{Command: "STAR"}},
+		{CommandParams: CommandParams{Command: "fastqc"}, Inputs: []string{"samtools"}},
+	}
+	job := Job{Commands: commands}
+	job.AssignStepNames()
+
+	var ids = make([]string, 0)
+	for _, cmd := range job.Commands {
+		ids = append(ids, cmd.StepID())
+	}
+	want := []string{"STAR", "samtools_index", "STAR_2", "STAR_3", "fastqc"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("step ids = %v, want %v", ids, want)
+	}
+
+	// STAR is a step ID, so the reference is kept. samtools is the tool of
+	// exactly one step, so it is rewritten to that step.
+	if got := job.Commands[1].Inputs[0]; got != "STAR" {
+		t.Errorf("input of samtools_index = %q, want %q", got, "STAR")
+	}
+	if got := job.Commands[4].Inputs[0]; got != "samtools_index" {
+		t.Errorf("input of fastqc = %q, want %q", got, "samtools_index")
+	}
+}
+
+func TestResolveCleanupSteps(t *testing.T) {
+	var commands = []Command{
+		{CommandParams: CommandParams{Command: "STAR"}},
+		{CommandParams: CommandParams{Command: "samtools", Subcommand: "index"}},
+		{CommandParams: CommandParams{Command: "fastqc"}},
+		{CommandParams: CommandParams{Command: "fastqc"}},
+	}
+	var tests = []struct {
+		name   string
+		action CleanupAction
+		step   string
+		err    string
+	}{
+		{"step", CleanupAction{Step: "samtools_index"}, "samtools_index", ""},
+		{"tool of one step", CleanupAction{ToolName: "samtools"}, "samtools_index", ""},
+		{"tool is a step id", CleanupAction{ToolName: "STAR"}, "STAR", ""},
+		{"step wins over tool", CleanupAction{Step: "fastqc_2", ToolName: "fastqc"}, "fastqc_2", ""},
+		{"tool of two steps", CleanupAction{ToolName: "fastqc"}, "", "run by steps fastqc, fastqc_2"},
+		{"unknown step", CleanupAction{Step: "samtools"}, "", `unknown step "samtools"`},
+		{"unknown tool", CleanupAction{ToolName: "bwa"}, "", `unknown tool "bwa"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := Job{Commands: append([]Command{}, commands...), CleanupActions: []CleanupAction{tt.action}}
+			job.AssignStepNames()
+			err := job.ResolveCleanupSteps()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ResolveCleanupSteps() error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveCleanupSteps() error = %v", err)
+			}
+			if got := job.CleanupActions[0].Step; got != tt.step {
+				t.Errorf("step = %q, want %q", got, tt.step)
+			}
+		})
+	}
+}
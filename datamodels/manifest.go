@@ -0,0 +1,41 @@
+package datamodels
+
+// Commander version recorded in provenance manifests. Release builds set it
+// with -ldflags "-X commander/datamodels.VERSION=<version>".
+var VERSION = "dev"
+
+// Name of the provenance manifest written to the config directory.
+const MANIFEST_FILE = "manifest.json"
+
+/* -----------------------------------------------------------------------------
+ * The provenance manifest records everything needed to tell how an analysis
+ * was generated and whether anything drifted since.
+ * -------------------------------------------------------------------------- */
+
+type Manifest struct {
+	CommanderVersion string          `json:"commander_version"`
+	GeneratedAt      string          `json:"generated_at"`
+	Host             string          `json:"host"`
+	User             string          `json:"user"`
+	Platform         string          `json:"platform"`
+	AnalysisID       string          `json:"analysis_id"`
+	AnalysisPath     string          `json:"analysis_path"`
+	Job              Job             `json:"job"`
+	Images           []ResolvedImage `json:"images"`
+	Inputs           []FileRecord    `json:"inputs"`
+	Scripts          []FileRecord    `json:"scripts"`
+}
+
+// A file known to the manifest. Files that are too large to hash on every
+// run, like raw reads, are recorded by size and modification time only.
+type FileRecord struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mtime,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	// What a script is for. The job script, which runs the whole analysis, is
+	// the "workflow".
+	Role string `json:"role,omitempty"`
+}
+
+const WORKFLOW_ROLE = "workflow"
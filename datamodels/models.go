@@ -2,7 +2,12 @@ package datamodels
 
 import (
 	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type SlurmPreamble struct {
@@ -12,7 +17,11 @@ type SlurmPreamble struct {
 	EmailEnd     bool
 	EmailFail    bool
 	EmailAddress string
-	WallTime     string
+	WallTime     WallTime
+	Account      string
+	QOS          string
+	Constraint   string
+	Exclusive    bool
 	MiscPreamble []string
 }
 type SGEPreamble struct {
@@ -21,7 +30,12 @@ type SGEPreamble struct {
 	Shell        string
 	EmailAddress string
 	ParallelEnv  string
-	Memory       string
+	// Memory for the whole job, requested from SGE per slot as MemoryResource.
+	Memory         Memory
+	MemoryResource string
+	// Other resources requested along with the memory, e.g. mem_free=4G.
+	Resources    []string
+	WallTime     WallTime
 	MiscPreamble []string
 }
 
@@ -29,15 +43,26 @@ type MiscPreamble struct {
 	Lines []string
 }
 
+// Memory is requested per CPU. The remaining settings override the job's
+// slurm preamble for the step.
 type CommandPreamble struct {
-	Tasks  int64
-	CPUs   int64
-	Memory int64
+	Tasks      int64
+	CPUs       int64
+	Memory     Memory
+	WallTime   WallTime
+	Partition  string
+	Account    string
+	QOS        string
+	Constraint string
+	Exclusive  bool
 }
 
 type CommandParams struct {
 	SingularityPath  string
 	SingularityImage string
+	Container        ContainerParams
+	Modules          []string
+	CondaEnv         string
 	WorkDir          string
 	Volumes          []VolumeMount
 	Command          string
@@ -46,32 +71,116 @@ type CommandParams struct {
 	CommandArgs      []string
 }
 
+type ContainerParams struct {
+	Runtime   string
+	Image     string
+	SHA256    string
+	ImageDir  string
+	AutoMount bool
+	Options   ContainerOptions
+}
+
+type ContainerOptions struct {
+	Mode     string
+	Env      map[string]string
+	CleanEnv bool
+	Contain  bool
+	GPU      bool
+	Overlays []string
+	Extra    []string
+}
+
+// How singularity style runtimes start the tool. CONTAINER_MODE_RUN hands the
+// command to the image runscript. CONTAINER_MODE_EXEC runs it directly.
+const (
+	CONTAINER_MODE_RUN  = "run"
+	CONTAINER_MODE_EXEC = "exec"
+)
+
+// An image as resolved by preflight. Recorded alongside the archived config.
+type ResolvedImage struct {
+	Step      string `json:"step"`
+	Runtime   string `json:"runtime"`
+	Reference string `json:"reference"`
+	Path      string `json:"path,omitempty"`
+	Digest    string `json:"digest"`
+}
+
+// Image URI schemes understood by the container runtimes.
+var IMAGE_URI_SCHEMES = []string{"docker://", "library://", "oras://"}
+
+// Supported container runtimes. RUNTIME_NONE runs the tool directly on the
+// host.
+const (
+	RUNTIME_SINGULARITY = "singularity"
+	RUNTIME_APPTAINER   = "apptainer"
+	RUNTIME_DOCKER      = "docker"
+	RUNTIME_PODMAN      = "podman"
+	RUNTIME_NONE        = "none"
+)
+
 type Job struct {
 	Details           JobDetails
 	ExperimentDetails Experiment
+	Container         ContainerParams
 	SlurmPreamble     SlurmPreamble
 	SGEPreamble       SGEPreamble
 	MiscPreamble      MiscPreamble
 	Commands          []Command
 	CleanupActions    []CleanupAction
 	CleanUp           []string
+	ClusterFile       string
 }
 
 type JobDetails struct {
-	Name       string
-	DesignFile string
-}
+	Name           string
+	DesignFile     string
+	PipelineMode   string
+	SubmissionMode string
+}
+
+// Supported pipeline modes. In batch mode every sample must finish a step
+// before any sample starts the next one. In per-sample mode each sample runs
+// its own chain of steps.
+const (
+	PIPELINE_MODE_BATCH      = "batch"
+	PIPELINE_MODE_PER_SAMPLE = "per_sample"
+)
+
+// Supported submission modes. In single mode the whole pipeline runs inside
+// one job. In separate mode every step (and every sample of a batch step) is
+// submitted as its own job that waits on the jobs of its input steps.
+const (
+	SUBMISSION_MODE_SINGLE   = "single"
+	SUBMISSION_MODE_SEPARATE = "separate"
+)
 
 type Command struct {
+	ID               string
 	Batch            bool
 	SamplesFile      string
-	InputFromStep    string
+	Inputs           []string
+	Outputs          map[string]string
+	InputPaths       map[string]string
 	InputPathPrefix  string
 	OutputPathPrefix string
+	HostOutputPath   string
+	ReferenceName    string
+	Reference        Reference
+	IndexPath        string
+	RuntimeIndexPath string
+	When             WhenClause
 	Preamble         CommandPreamble
 	CommandParams    CommandParams
 }
 
+type Reference struct {
+	Name    string
+	FASTA   string
+	GTF     string
+	Indexes map[string]string
+}
+
 type BatchParams struct {
 	SamplePrefix string
 	ForwardReads []string
@@ -79,15 +188,26 @@ type BatchParams struct {
 }
 
 type Experiment struct {
-	PI           string
-	Name         string
-	AnalysisID   string
-	SamplePath   string
-	AnalysisPath string
-	WorkDir      string
-	SamplesFile  string
-	Samples      []Sample
-}
+	PI                 string
+	Name               string
+	AnalysisID         string
+	AnalysisIDStrategy string
+	SamplePath         string
+	AnalysisPath       string
+	WorkDir            string
+	SamplesFile        string
+	Samples            []Sample
+}
+
+// Ways of generating an analysis ID when the param file does not give one.
+const (
+	ANALYSIS_ID_TIMESTAMP = "timestamp"
+	ANALYSIS_ID_HASH      = "hash"
+	ANALYSIS_ID_COUNTER   = "counter"
+)
+
+// Layout of timestamp analysis IDs.
+const ANALYSIS_ID_TIME_FORMAT = "20060102-150405"
 
 type Sample struct {
 	SamplePath      string
@@ -95,9 +215,19 @@ type Sample struct {
 	Prefix          string
 	ForwardReadFile string
 	ReverseReadFile string
+	Metadata        map[string]string
+}
+
+type WhenClause struct {
+	PairedEnd *bool
+	Prefix    string
+	Metadata  map[string]string
 }
 
 type CleanupAction struct {
+	// Step whose output directory holds the source. Set from the "step" key,
+	// or from a "tool_name" that matches exactly one step.
+	Step        string
 	ToolName    string
 	Action      string
 	Source      string
@@ -125,6 +255,149 @@ func (c *CommandParams) PrintMountString() string {
 	return mountString
 }
 
+/* ---
+ * Return the container runtime for the command. Singularity is the default.
+ * --- */
+func (c *CommandParams) ContainerRuntime() string {
+	if c.Container.Runtime == "" {
+		return RUNTIME_SINGULARITY
+	}
+	return c.Container.Runtime
+}
+
+func (c *CommandParams) UsesContainer() bool {
+	if c.ContainerRuntime() == RUNTIME_NONE {
+		return false
+	}
+	return true
+}
+
+/* ---
+ * Return the image reference handed to the container runtime. An explicit
+ * container image wins. Otherwise Singularity style runtimes use the image
+ * file under the singularity path and Docker style runtimes use the image
+ * name as given. Singularity style runtimes use the cached copy of an image
+ * URI when an image directory is configured.
+ * --- */
+func (c *CommandParams) ImageReference() string {
+	switch c.ContainerRuntime() {
+	case RUNTIME_SINGULARITY, RUNTIME_APPTAINER:
+		if c.Container.Image == "" {
+			return fmt.Sprintf("%s/%s", c.SingularityPath, c.SingularityImage)
+		}
+		if c.IsImageURI() && c.Container.ImageDir != "" {
+			return c.CachedImagePath()
+		}
+		return c.Container.Image
+	default:
+		if c.Container.Image == "" {
+			return c.SingularityImage
+		}
+		// Docker and podman take registry references without a scheme.
+		return strings.TrimPrefix(c.Container.Image, "docker://")
+	}
+}
+
+/* ---
+ * Return the image as given in the param file, before any caching.
+ * --- */
+func (c *CommandParams) SourceImage() string {
+	if c.Container.Image != "" {
+		return c.Container.Image
+	}
+	if c.ContainerRuntime() == RUNTIME_SINGULARITY || c.ContainerRuntime() == RUNTIME_APPTAINER {
+		return fmt.Sprintf("%s/%s", c.SingularityPath, c.SingularityImage)
+	}
+	return c.SingularityImage
+}
+
+func (c *CommandParams) IsImageURI() bool {
+	for _, scheme := range IMAGE_URI_SCHEMES {
+		if strings.HasPrefix(c.SourceImage(), scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+/* ---
+ * Return the digest pinned in the image reference, e.g. "sha256:abc..." for
+ * "docker://quay.io/biocontainers/star@sha256:abc...". Empty if the image is
+ * referenced by tag only.
+ * --- */
+func (c *CommandParams) ImageDigest() string {
+	chunks := strings.SplitN(c.SourceImage(), "@", 2)
+	if len(chunks) == 2 {
+		return chunks[1]
+	}
+	if c.Container.SHA256 != "" {
+		return fmt.Sprintf("sha256:%s", c.Container.SHA256)
+	}
+	return ""
+}
+
+/* ---
+ * Return the path an image URI is pulled into under the image directory. The
+ * name carries the digest so a new pin never reuses a stale pull.
+ * --- */
+func (c *CommandParams) CachedImagePath() string {
+	name := c.SourceImage()
+	for _, scheme := range IMAGE_URI_SCHEMES {
+		name = strings.TrimPrefix(name, scheme)
+	}
+	name = strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(name)
+	return fmt.Sprintf("%s/%s.sif", c.Container.ImageDir, name)
+}
+
+/* ---
+ * Check if the conda environment is given as an environment file rather than
+ * the name of an existing environment.
+ * --- */
+func (c *CommandParams) IsCondaEnvFile() bool {
+	if strings.HasSuffix(c.CondaEnv, ".yml") || strings.HasSuffix(c.CondaEnv, ".yaml") {
+		return true
+	}
+	return false
+}
+
+/* ---
+ * Return the prefix a conda environment file is built into. Environments live
+ * under <analysis_path>/envs so every sample shares one build.
+ * --- */
+func (c *CommandParams) CondaEnvPrefix(analysisPath string) string {
+	name := filepath.Base(c.CondaEnv)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".yml"), ".yaml")
+	return fmt.Sprintf("%s/envs/%s", analysisPath, name)
+}
+
+/* ---
+ * Return the container environment variables sorted by name so the generated
+ * scripts are stable.
+ * --- */
+func (o *ContainerOptions) SortedEnv() []string {
+	var env = make([]string, 0)
+	for key, value := range o.Env {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(env)
+	return env
+}
+
+func (o *ContainerOptions) ContainerMode() string {
+	if o.Mode == "" {
+		return CONTAINER_MODE_RUN
+	}
+	return o.Mode
+}
+
+func IsSupportedRuntime(runtime string) bool {
+	switch runtime {
+	case RUNTIME_SINGULARITY, RUNTIME_APPTAINER, RUNTIME_DOCKER, RUNTIME_PODMAN, RUNTIME_NONE:
+		return true
+	}
+	return false
+}
+
 func (j *Job) IsPipeline() bool {
 	if len(j.Commands) > 1 {
 		return true
@@ -132,40 +405,172 @@ func (j *Job) IsPipeline() bool {
 	return false
 }
 
-func (j *Job) InitializeCMDIOPaths() {
-	var samplePath, analysisPath string
+func (d *JobDetails) IsSeparateSubmission() bool {
+	return d.SubmissionMode == SUBMISSION_MODE_SEPARATE
+}
+
+func (d *JobDetails) IsPerSample() bool {
+	if d.PipelineMode == PIPELINE_MODE_PER_SAMPLE {
+		return true
+	}
+	return false
+}
+
+func (j *Job) InitializeCMDIOPaths() error {
+	var hostOutputPaths = make(map[string]string)
 	for i := range j.Commands {
+		// Make sure every host path the step needs is mounted.
+		if err := j.CheckMounts(i); err != nil {
+			return err
+		}
+
 		cmd := j.Commands[i]
-		for _, v := range cmd.CommandParams.Volumes {
-			if strings.Contains(j.ExperimentDetails.PrintRawSamplePath(), v.HostPath) {
-				// Replace the parent path to the sample directory with the container mount path.
-				samplePath = strings.ReplaceAll(j.ExperimentDetails.PrintRawSamplePath(), v.HostPath, v.ContainerPath)
-			}
-			if strings.Contains(j.ExperimentDetails.PrintAnalysisPath(), v.HostPath) {
-				// Replace the parent path to the sample directory with the container mount path.
-				analysisPath = strings.ReplaceAll(j.ExperimentDetails.PrintAnalysisPath(), v.HostPath, v.ContainerPath)
-			}
+		// Replace the parent paths to the sample and analysis directories
+		// with the container mount paths. Standalone commands may leave them
+		// unmapped, in which case they stay empty.
+		samplePath := j.stepRuntimePath(cmd, j.ExperimentDetails.PrintRawSamplePath())
+		analysisPath := j.stepRuntimePath(cmd, j.ExperimentDetails.PrintAnalysisPath())
+
+		// The output path prefix should account for the step name
+		j.Commands[i].OutputPathPrefix = fmt.Sprintf("%s/%s", analysisPath, j.Commands[i].StepID())
+		j.Commands[i].HostOutputPath = fmt.Sprintf("%s/%s", j.ExperimentDetails.PrintAnalysisPath(), cmd.StepID())
+		hostOutputPaths[cmd.StepID()] = j.Commands[i].HostOutputPath
+
+		// The reference index as the command sees it.
+		if cmd.IndexPath != "" {
+			j.Commands[i].RuntimeIndexPath = j.stepRuntimePath(cmd, cmd.IndexPath)
 		}
-		if j.Commands[i].InputFromStep == "" {
+
+		if len(j.Commands[i].Inputs) == 0 {
 			// Command does not expext input as output from a previous command.
 			// Use raw sample path as input path prefix.
 			j.Commands[i].InputPathPrefix = samplePath
-		} else {
-			// Otherwise, the input is the output of a previous step in the
-			// pipeline. The input path should reflect this
-			j.Commands[i].InputPathPrefix = fmt.Sprintf("%s/%s", analysisPath, j.Commands[i].InputFromStep)
 		}
+	}
+
+	// Steps may be declared in any order, so resolve the inputs once every
+	// output path is known.
+	for i := range j.Commands {
+		j.Commands[i].InputPaths = make(map[string]string)
+		for n, input := range j.Commands[i].Inputs {
+			// The input is the output of another step in the pipeline. The
+			// input path should reflect this, as seen through this command's
+			// own mounts.
+			ref := ParseStepRef(input)
+			dir := j.stepRuntimePath(j.Commands[i], hostOutputPaths[ref.StepID])
+			path := dir
+			if ref.Output != "" {
+				parent := j.Commands[j.stepIndex(ref.StepID)]
+				path = fmt.Sprintf("%s/%s", path, parent.Outputs[ref.Output])
+			}
+			j.Commands[i].InputPaths[input] = path
 
-		// The output path prefix should account for the tool name
-		j.Commands[i].OutputPathPrefix = fmt.Sprintf("%s/%s", analysisPath, j.Commands[i].CommandName())
+			// The first input doubles as the input path prefix used by the
+			// tool specific formatting.
+			if n == 0 {
+				j.Commands[i].InputPathPrefix = dir
+			}
+		}
 	}
+	return nil
+}
+
+/* ---
+ * Give every command without an explicit id a stable unique step name. Repeats
+ * of the same command and subcommand are numbered in declaration order, e.g.
+ * "STAR", "STAR_2". Input references that use a bare tool name are rewritten
+ * to the step name when exactly one step runs that tool.
+ * --- */
+func (j *Job) AssignStepNames() {
+	var taken = make(map[string]bool)
+	for i := range j.Commands {
+		if j.Commands[i].ID != "" {
+			taken[j.Commands[i].ID] = true
+		}
+	}
+
+	for i := range j.Commands {
+		if j.Commands[i].ID != "" {
+			continue
+		}
+		name := j.Commands[i].DefaultStepID()
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s_%d", j.Commands[i].DefaultStepID(), n)
+		}
+		j.Commands[i].ID = name
+		taken[name] = true
+	}
+
+	for i := range j.Commands {
+		for n, input := range j.Commands[i].Inputs {
+			ref := ParseStepRef(input)
+			if taken[ref.StepID] {
+				continue
+			}
+			var matches = make([]string, 0)
+			for _, cmd := range j.Commands {
+				if cmd.CommandName() == ref.StepID {
+					matches = append(matches, cmd.StepID())
+				}
+			}
+			if len(matches) == 1 {
+				ref.StepID = matches[0]
+				j.Commands[i].Inputs[n] = ref.String()
+			}
+		}
+	}
+}
+
+/* ---
+ * Set the step of every cleanup action. A "tool_name" is only accepted when
+ * it is the tool of exactly one step, or of none but a step ID, since output
+ * directories are named by step ID.
+ * --- */
+func (j *Job) ResolveCleanupSteps() error {
+	for i := range j.CleanupActions {
+		cua := &j.CleanupActions[i]
+		if cua.Step != "" {
+			if j.stepIndex(cua.Step) < 0 {
+				return fmt.Errorf(`pipeline error: cleanup action "%s %s" refers to unknown step "%s"`, cua.Action, cua.Source, cua.Step)
+			}
+			continue
+		}
+		var matches = make([]string, 0)
+		for _, cmd := range j.Commands {
+			if cmd.CommandName() == cua.ToolName {
+				matches = append(matches, cmd.StepID())
+			}
+		}
+		switch len(matches) {
+		case 1:
+			cua.Step = matches[0]
+		case 0:
+			if j.stepIndex(cua.ToolName) >= 0 {
+				cua.Step = cua.ToolName
+				continue
+			}
+			return fmt.Errorf(`pipeline error: cleanup action "%s %s" refers to unknown tool "%s"`, cua.Action, cua.Source, cua.ToolName)
+		default:
+			return fmt.Errorf(`pipeline error: tool "%s" of cleanup action "%s %s" is run by steps %s. Name one with "step"`, cua.ToolName, cua.Action, cua.Source, strings.Join(matches, ", "))
+		}
+	}
+	return nil
+}
+
+func (j *Job) stepIndex(id string) int {
+	for i := range j.Commands {
+		if j.Commands[i].StepID() == id {
+			return i
+		}
+	}
+	return -1
 }
 
 func (j *Job) FormatCleanupActions() []string {
 	var cleanupActions = make([]string, 0)
 
 	for _, cua := range j.CleanupActions {
-		sourcePath := fmt.Sprintf("%s/%s/%s", j.ExperimentDetails.PrintAnalysisPath(), cua.ToolName, cua.Source)
+		sourcePath := fmt.Sprintf("%s/%s/%s", j.ExperimentDetails.PrintAnalysisPath(), cua.Step, cua.Source)
 		if cua.Action == "mv" || cua.Action == "cp" {
 			destPath := fmt.Sprintf("%s/%s", j.ExperimentDetails.PrintAnalysisPath(), cua.Destination)
 			actionString := fmt.Sprintf("%s %s %s", cua.Action, sourcePath, destPath)
@@ -188,7 +593,8 @@ func DefaultExperiment() Experiment {
 		Name:         "COMMANDER_TEST",
 		SamplePath:   "./compbio/data",
 		AnalysisPath: "./compbio/analysis",
-		AnalysisID:   "1234567890",
+		// The analysis ID is generated once the params are resolved.
+		AnalysisIDStrategy: ANALYSIS_ID_TIMESTAMP,
 	}
 }
 
@@ -199,14 +605,49 @@ func (e *Experiment) IsEmpty() bool {
 	return false
 }
 
+/* ---
+ * Set a new analysis ID from the current time.
+ * --- */
 func (e *Experiment) NewAnalysisID() {
-	e.AnalysisID = "1234567890"
+	e.AnalysisID = time.Now().Format(ANALYSIS_ID_TIME_FORMAT)
+}
+
+/* ---
+ * Check if an analysis ID strategy is known.
+ * --- */
+func IsAnalysisIDStrategy(strategy string) bool {
+	switch strategy {
+	case ANALYSIS_ID_TIMESTAMP, ANALYSIS_ID_HASH, ANALYSIS_ID_COUNTER:
+		return true
+	}
+	return false
+}
+
+// Splits an analysis ID into its prefix and trailing number.
+var trailingNumber = regexp.MustCompile(`^(.*?)([0-9]+)$`)
+
+/* ---
+ * Move on to the next analysis ID. A trailing number is incremented keeping
+ * its zero padding, e.g. run09 becomes run10. IDs without one get a _2 suffix.
+ * --- */
+func (e *Experiment) IncrementAnalysisID() {
+	match := trailingNumber.FindStringSubmatch(e.AnalysisID)
+	if match == nil {
+		e.AnalysisID = fmt.Sprintf("%s_2", e.AnalysisID)
+		return
+	}
+	n, _ := strconv.Atoi(match[2])
+	e.AnalysisID = fmt.Sprintf("%s%0*d", match[1], len(match[2]), n+1)
 }
 
 func (e *Experiment) PrintRawSamplePath() string {
 	return fmt.Sprintf("%s/%s/%s", e.SamplePath, e.PI, e.Name)
 }
 
+func (e *Experiment) PrintExperimentPath() string {
+	return fmt.Sprintf("%s/%s/%s", e.AnalysisPath, e.PI, e.Name)
+}
+
 func (e *Experiment) PrintAnalysisPath() string {
 	return fmt.Sprintf("%s/%s/%s/%s", e.AnalysisPath, e.PI, e.Name, e.AnalysisID)
 }
@@ -221,6 +662,60 @@ func (e *Experiment) InitializePaths() {
 	}
 }
 
+/* ---
+ * Return the step preamble with the job's slurm preamble filling in every
+ * setting the step leaves unset. Unset tasks and CPUs are one, as for Slurm.
+ * --- */
+func (p CommandPreamble) WithDefaults(job SlurmPreamble) CommandPreamble {
+	if p.Tasks == 0 {
+		p.Tasks = 1
+	}
+	if p.CPUs == 0 {
+		p.CPUs = 1
+	}
+	if p.WallTime == 0 {
+		p.WallTime = job.WallTime
+	}
+	if p.Partition == "" {
+		p.Partition = job.Partition
+	}
+	if p.Account == "" {
+		p.Account = job.Account
+	}
+	if p.QOS == "" {
+		p.QOS = job.QOS
+	}
+	if p.Constraint == "" {
+		p.Constraint = job.Constraint
+	}
+	p.Exclusive = p.Exclusive || job.Exclusive
+	return p
+}
+
+/* ---
+ * Return the number of slots of the parallel environment, e.g. 16 for
+ * "smp 16". A parallel environment without a slot count has one slot.
+ * --- */
+func (p *SGEPreamble) Slots() int64 {
+	fields := strings.Fields(p.ParallelEnv)
+	if len(fields) < 2 {
+		return 1
+	}
+	slots, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil || slots < 1 {
+		return 1
+	}
+	return slots
+}
+
+/* ---
+ * Check if the job is a single non-batch command written straight into the
+ * job script. Its memory is for the whole job rather than per CPU.
+ * --- */
+func (j *Job) IsStandaloneCommand() bool {
+	return len(j.Commands) == 1 && !j.Commands[0].Batch && !j.Details.IsSeparateSubmission()
+}
+
 func (j *Job) MaxCPUUsage() int64 {
 	var maxCPU = int64(0)
 
@@ -232,6 +727,74 @@ func (j *Job) MaxCPUUsage() int64 {
 	return maxCPU
 }
 
+/* ---
+ * Return the unique step name of the command. The step name is used for the
+ * output directory, script names, logs and input references.
+ * --- */
+func (c *Command) StepID() string {
+	if c.ID != "" {
+		return c.ID
+	}
+	return c.DefaultStepID()
+}
+
+/* ---
+ * Return the host path of the completion sentinel for the command. Batch
+ * commands have one sentinel per sample.
+ * --- */
+func (c *Command) SentinelPath(sample *Sample) string {
+	if sample != nil {
+		return fmt.Sprintf("%s/%s_%s", c.HostOutputPath, SENTINEL_FILE, sample.Prefix)
+	}
+	return fmt.Sprintf("%s/%s", c.HostOutputPath, SENTINEL_FILE)
+}
+
+/* ---
+ * Derive a step name from the command and subcommand, e.g. "samtools_sort".
+ * --- */
+func (c *Command) DefaultStepID() string {
+	if c.SubCommandName() != "" {
+		return fmt.Sprintf("%s_%s", c.CommandName(), c.SubCommandName())
+	}
+	return c.CommandName()
+}
+
+/* ---
+ * Expand the placeholders in an option or argument. {input:<ref>} is replaced
+ * with the resolved path of an input and {sample} with the sample prefix.
+ * --- */
+func (c *Command) ExpandPlaceholders(s string, sample *Sample) string {
+	for ref, path := range c.InputPaths {
+		s = strings.ReplaceAll(s, fmt.Sprintf("{input:%s}", ref), path)
+	}
+	if sample != nil {
+		s = strings.ReplaceAll(s, "{sample}", sample.Prefix)
+	}
+	return s
+}
+
+/* ---
+ * Return a copy of the command with the placeholders in its options and
+ * arguments expanded.
+ * --- */
+func (c *Command) Expanded(sample *Sample) Command {
+	expanded := *c
+	expanded.CommandParams.CommandOptions = make([]string, 0)
+	for _, opt := range c.CommandParams.CommandOptions {
+		expanded.CommandParams.CommandOptions = append(expanded.CommandParams.CommandOptions, c.ExpandPlaceholders(opt, sample))
+	}
+	expanded.CommandParams.CommandArgs = make([]string, 0)
+	for _, arg := range c.CommandParams.CommandArgs {
+		expanded.CommandParams.CommandArgs = append(expanded.CommandParams.CommandArgs, c.ExpandPlaceholders(arg, sample))
+	}
+
+	// Hand the reference index to the tool.
+	if adapter, ok := AdapterFor(*c); ok && c.RuntimeIndexPath != "" {
+		adapter.InsertIndex(&expanded.CommandParams, c.RuntimeIndexPath)
+	}
+	return expanded
+}
+
 func (c *Command) CommandName() string {
 	return c.CommandParams.Command
 }
@@ -319,3 +882,39 @@ func (s *Sample) DumpReverseReadFileWithPath() string {
 	readFileString := fmt.Sprintf("%s/%s", s.SamplePath, s.ReverseReadFile)
 	return readFileString
 }
+
+/* --- When clause functions --- */
+func (w *WhenClause) IsEmpty() bool {
+	if w.PairedEnd == nil && w.Prefix == "" && len(w.Metadata) == 0 {
+		return true
+	}
+	return false
+}
+
+/* ---
+ * Evaluate the clause against a sample. When the sample does not match, the
+ * returned reason names the first condition that failed.
+ * --- */
+func (w *WhenClause) Matches(s Sample) (bool, string) {
+	if w.PairedEnd != nil && s.IsPairedEnd() != *w.PairedEnd {
+		return false, fmt.Sprintf("paired_end is %t", s.IsPairedEnd())
+	}
+	if w.Prefix != "" {
+		matched, err := regexp.MatchString(w.Prefix, s.Prefix)
+		if err != nil || !matched {
+			return false, fmt.Sprintf("prefix does not match %s", w.Prefix)
+		}
+	}
+	// Check keys in order so a sample always reports the same mismatch.
+	var keys = make([]string, 0, len(w.Metadata))
+	for key := range w.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if s.Metadata[key] != w.Metadata[key] {
+			return false, fmt.Sprintf("metadata %s is not %s", key, w.Metadata[key])
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,30 @@
+package datamodels
+
+import "testing"
+
+func TestWhenClauseMatches(t *testing.T) {
+	yes := true
+	sample := Sample{Prefix: "A", ForwardReadFile: "A_R1.fastq.gz", Metadata: map[string]string{"qc": "yes", "tissue": "liver"}}
+	var tests = []struct {
+		name    string
+		when    WhenClause
+		matches bool
+		reason  string
+	}{
+		{"empty", WhenClause{}, true, ""},
+		{"metadata", WhenClause{Metadata: map[string]string{"qc": "yes", "tissue": "liver"}}, true, ""},
+		{"paired end", WhenClause{PairedEnd: &yes}, false, "paired_end is false"},
+		{"prefix", WhenClause{Prefix: "^B"}, false, "prefix does not match ^B"},
+		{"first key in order", WhenClause{Metadata: map[string]string{"tissue": "brain", "batch": "2", "qc": "no"}}, false, "metadata batch is not 2"},
+	}
+
+	for _, tt := range tests {
+		// Map order changes between runs, so check the reason a few times.
+		for i := 0; i < 10; i++ {
+			matches, reason := tt.when.Matches(sample)
+			if matches != tt.matches || reason != tt.reason {
+				t.Fatalf("%s: Matches() = %t, %q, want %t, %q", tt.name, matches, reason, tt.matches, tt.reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package datamodels
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+/* -----------------------------------------------------------------------------
+ * Mapping host paths into containers.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Map a host path to its path inside the container. The mount with the
+ * longest host path that contains the path wins. Mounts only match on whole
+ * path components, so /data does not cover /data2.
+ * --- */
+func (c *CommandParams) ContainerPath(hostPath string) (string, bool) {
+	var best *VolumeMount
+	for i := range c.Volumes {
+		v := &c.Volumes[i]
+		if !pathWithin(hostPath, v.HostPath) {
+			continue
+		}
+		if best == nil || len(filepath.Clean(v.HostPath)) > len(filepath.Clean(best.HostPath)) {
+			best = v
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(filepath.Clean(best.HostPath), filepath.Clean(hostPath))
+	if err != nil {
+		return "", false
+	}
+	if rel == "." {
+		return filepath.Clean(best.ContainerPath), true
+	}
+	return filepath.Join(best.ContainerPath, rel), true
+}
+
+/* ---
+ * Return the path a command sees for a host path. Commands that run on the
+ * host see the path as it is. Paths no mount covers come back empty.
+ * --- */
+func (c *CommandParams) RuntimePath(hostPath string) string {
+	if !c.UsesContainer() {
+		return hostPath
+	}
+	path, _ := c.ContainerPath(hostPath)
+	return path
+}
+
+/* ---
+ * Return the path a step sees for a host path. Relative host paths are taken
+ * relative to the work directory before they are matched to a mount.
+ * --- */
+func (j *Job) stepRuntimePath(cmd Command, hostPath string) string {
+	if !cmd.CommandParams.UsesContainer() {
+		return hostPath
+	}
+	return cmd.CommandParams.RuntimePath(j.ExperimentDetails.AbsHostPath(hostPath))
+}
+
+/* ---
+ * Return a host path as an absolute path. Relative paths are taken relative
+ * to the work directory, or to the current directory without one.
+ * --- */
+func (e *Experiment) AbsHostPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	if e.WorkDir != "" {
+		path = filepath.Join(e.WorkDir, path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+/* ---
+ * Mount a host path at the same path inside the container. Bind mounts need
+ * absolute paths on both sides.
+ * --- */
+func (c *CommandParams) AddMount(hostPath string) error {
+	hostPath, err := filepath.Abs(hostPath)
+	if err != nil {
+		return err
+	}
+	c.Volumes = append(c.Volumes, VolumeMount{HostPath: hostPath, ContainerPath: hostPath})
+	return nil
+}
+
+/* ---
+ * Return the host paths a step reads from or writes to. Standalone non-batch
+ * commands carry their own paths in their options, so nothing is required of
+ * them.
+ * --- */
+func (j *Job) RequiredHostPaths(cmd Command) []string {
+	var paths = make([]string, 0)
+
+	if cmd.Batch && len(cmd.Inputs) == 0 && len(j.ExperimentDetails.Samples) > 0 {
+		// The step reads the raw sample files.
+		paths = append(paths, j.ExperimentDetails.PrintRawSamplePath())
+	}
+
+	if cmd.Batch || len(cmd.Inputs) > 0 || j.isInputToAnyStep(cmd.StepID()) {
+		// The step writes into the analysis directory, or reads another
+		// step's output from it.
+		paths = append(paths, j.ExperimentDetails.PrintAnalysisPath())
+	}
+
+	if adapter, ok := AdapterFor(cmd); ok && cmd.IndexPath != "" {
+		// The step reads the reference index.
+		paths = append(paths, adapter.IndexMountPath(cmd.IndexPath))
+	}
+	return paths
+}
+
+/* ---
+ * Check every host path a step needs is covered by a mount. Missing mounts
+ * are added when the command asks for it. Otherwise an error lists every path
+ * that is not covered. Relative host paths of volumes are made absolute, and
+ * container paths must be absolute.
+ * --- */
+func (j *Job) CheckMounts(i int) error {
+	cmd := &j.Commands[i]
+	if !cmd.CommandParams.UsesContainer() {
+		return nil
+	}
+
+	for n := range cmd.CommandParams.Volumes {
+		v := &cmd.CommandParams.Volumes[n]
+		if !filepath.IsAbs(v.ContainerPath) {
+			return fmt.Errorf(`path error: step "%s" mounts %s at "%s", which is not an absolute path`, cmd.StepID(), v.HostPath, v.ContainerPath)
+		}
+		v.HostPath = j.ExperimentDetails.AbsHostPath(v.HostPath)
+	}
+
+	var missing = make([]string, 0)
+	for _, path := range j.RequiredHostPaths(*cmd) {
+		path = j.ExperimentDetails.AbsHostPath(path)
+		if _, ok := cmd.CommandParams.ContainerPath(path); ok {
+			continue
+		}
+		if cmd.CommandParams.Container.AutoMount {
+			if err := cmd.CommandParams.AddMount(path); err != nil {
+				return err
+			}
+			continue
+		}
+		missing = append(missing, path)
+	}
+
+	if len(missing) > 0 {
+		mounts := cmd.CommandParams.PrintMountString()
+		if mounts == "" {
+			mounts = "none"
+		}
+		return fmt.Errorf(
+			"path error: step \"%s\" needs %s but no volume mounts it. Volumes: %s. Add a volume covering the path or set \"auto_mount\": true in the container block",
+			cmd.StepID(),
+			strings.Join(missing, ", "),
+			mounts,
+		)
+	}
+	return nil
+}
+
+func (j *Job) isInputToAnyStep(id string) bool {
+	for _, cmd := range j.Commands {
+		for _, input := range cmd.Inputs {
+			ref := ParseStepRef(input)
+			if ref.StepID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* ---
+ * Check if path lies within dir, comparing whole path components.
+ * --- */
+func pathWithin(path, dir string) bool {
+	path = filepath.Clean(path)
+	dir = filepath.Clean(dir)
+	if path == dir || dir == "/" {
+		return true
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
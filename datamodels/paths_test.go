@@ -0,0 +1,80 @@
+package datamodels
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAbsHostPath(t *testing.T) {
+	var tests = []struct {
+		workDir string
+		path    string
+		want    string
+	}{
+		{"/work", "data/ref", "/work/data/ref"},
+		{"/work", "../ref", "/ref"},
+		{"/work", "/ref/hg38", "/ref/hg38"},
+		{"/work", "", ""},
+	}
+
+	for _, tt := range tests {
+		e := Experiment{WorkDir: tt.workDir}
+		if got := e.AbsHostPath(tt.path); got != tt.want {
+			t.Errorf("AbsHostPath(%q) with workdir %s = %q, want %q", tt.path, tt.workDir, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMounts(t *testing.T) {
+	experiment := Experiment{PI: "pi", Name: "exp", AnalysisID: "a1", SamplePath: "data", AnalysisPath: "analysis", WorkDir: "/work"}
+	var tests = []struct {
+		name    string
+		volumes []VolumeMount
+		auto    bool
+		mounts  string
+		err     string
+	}{
+		{
+			name:   "relative paths mounted as absolute",
+			auto:   true,
+			mounts: "/work/analysis/pi/exp/a1:/work/analysis/pi/exp/a1",
+		},
+		{
+			name:    "relative host path of a volume",
+			volumes: []VolumeMount{{HostPath: "analysis", ContainerPath: "/analysis"}},
+			mounts:  "/work/analysis:/analysis",
+		},
+		{
+			name:    "relative container path",
+			volumes: []VolumeMount{{HostPath: "analysis", ContainerPath: "analysis"}},
+			err:     `at "analysis", which is not an absolute path`,
+		},
+		{
+			name: "not mounted",
+			err:  "needs /work/analysis/pi/exp/a1 but no volume mounts it",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := Command{ID: "STAR", Inputs: []string{"trim"}, CommandParams: CommandParams{Command: "STAR"}}
+			cmd.CommandParams.Volumes = append([]VolumeMount{}, tt.volumes...)
+			cmd.CommandParams.Container.AutoMount = tt.auto
+			job := Job{ExperimentDetails: experiment, Commands: []Command{cmd}}
+
+			err := job.CheckMounts(0)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("CheckMounts() error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckMounts() error = %v", err)
+			}
+			if got := job.Commands[0].CommandParams.PrintMountString(); got != tt.mounts {
+				t.Errorf("mounts = %q, want %q", got, tt.mounts)
+			}
+		})
+	}
+}
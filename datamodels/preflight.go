@@ -0,0 +1,40 @@
+package datamodels
+
+// Outcomes of a single preflight check.
+const (
+	CHECK_PASS = "pass"
+	CHECK_WARN = "warn"
+	CHECK_FAIL = "fail"
+	CHECK_SKIP = "skip"
+)
+
+/* -----------------------------------------------------------------------------
+ * Results of the preflight checks.
+ * -------------------------------------------------------------------------- */
+
+type CheckResult struct {
+	Name     string   `json:"name"`
+	Status   string   `json:"status"`
+	Details  []string `json:"details,omitempty"`
+	Duration float64  `json:"duration_seconds"`
+}
+
+type PreflightReport struct {
+	AnalysisPath string        `json:"analysis_path"`
+	GeneratedAt  string        `json:"generated_at"`
+	Status       string        `json:"status"`
+	Checks       []CheckResult `json:"checks"`
+}
+
+/* ---
+ * Count the checks with a given status.
+ * --- */
+func (r *PreflightReport) Count(status string) int {
+	var n = 0
+	for _, c := range r.Checks {
+		if c.Status == status {
+			n++
+		}
+	}
+	return n
+}
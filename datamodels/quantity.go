@@ -0,0 +1,228 @@
+package datamodels
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An amount of memory in megabytes. Parameter files give memory as a number
+// of megabytes or with a unit, e.g. 500M or 16G. Units are powers of 1024, as
+// for Slurm and SGE.
+type Memory int64
+
+// A wall time in seconds. Parameter files give wall time in any of the Slurm
+// formats, e.g. 2-00:00:00 or 90, or with units, e.g. 36h or 1d12h.
+type WallTime int64
+
+var memoryPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([KMGTkmgt]?)[Bb]?$`)
+var wallTimeUnitPattern = regexp.MustCompile(`([0-9]+)([dhms])`)
+
+// Megabytes per memory unit.
+var MEMORY_UNITS = map[string]float64{
+	"K": 1.0 / 1024,
+	"M": 1,
+	"G": 1024,
+	"T": 1024 * 1024,
+}
+
+/* ---
+ * Parse a memory quantity. A bare number is in megabytes.
+ * --- */
+func ParseMemory(value string) (Memory, error) {
+	value = strings.TrimSpace(value)
+	match := memoryPattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf(`resource error: "%s" is not an amount of memory. Use e.g. 500M or 16G`, value)
+	}
+
+	amount, _ := strconv.ParseFloat(match[1], 64)
+	unit := strings.ToUpper(match[2])
+	if unit == "" {
+		unit = "M"
+	}
+	megabytes := int64(math.Ceil(amount * MEMORY_UNITS[unit]))
+	if megabytes <= 0 {
+		return 0, fmt.Errorf(`resource error: memory "%s" must be more than zero`, value)
+	}
+	return Memory(megabytes), nil
+}
+
+/* ---
+ * Return the memory split over n CPUs or slots, rounded up.
+ * --- */
+func (m Memory) Per(n int64) Memory {
+	if n <= 1 {
+		return m
+	}
+	return Memory((int64(m) + n - 1) / n)
+}
+
+/* ---
+ * Return the memory taken by n CPUs or slots.
+ * --- */
+func (m Memory) Times(n int64) Memory {
+	return Memory(int64(m) * n)
+}
+
+/* ---
+ * Format the memory in the largest whole unit, e.g. 16G or 1500M. Slurm
+ * (--mem, --mem-per-cpu) and SGE (h_vmem) both read this format.
+ * --- */
+func (m Memory) String() string {
+	switch {
+	case m > 0 && m%(1024*1024) == 0:
+		return fmt.Sprintf("%dT", m/(1024*1024))
+	case m > 0 && m%1024 == 0:
+		return fmt.Sprintf("%dG", m/1024)
+	}
+	return fmt.Sprintf("%dM", m)
+}
+
+// Unset values are written as an empty string.
+func (m Memory) MarshalText() ([]byte, error) {
+	if m == 0 {
+		return []byte{}, nil
+	}
+	return []byte(m.String()), nil
+}
+
+func (m *Memory) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*m = 0
+		return nil
+	}
+	parsed, err := ParseMemory(string(text))
+	*m = parsed
+	return err
+}
+
+/* ---
+ * Parse a wall time. Slurm accepts "minutes", "minutes:seconds",
+ * "hours:minutes:seconds", "days-hours", "days-hours:minutes" and
+ * "days-hours:minutes:seconds". Times with units are any run of numbers
+ * followed by d, h, m or s, e.g. 36h or 1h30m.
+ * --- */
+func ParseWallTime(value string) (WallTime, error) {
+	value = strings.TrimSpace(value)
+	invalid := fmt.Errorf(`resource error: "%s" is not a wall time. Use e.g. 02:00:00, 2-00:00:00 or 36h`, value)
+
+	var seconds int64
+	if strings.ContainsAny(value, "dhms") {
+		// Every character must belong to a number and unit pair.
+		matched := wallTimeUnitPattern.FindAllStringSubmatch(value, -1)
+		if strings.Join(wallTimeUnitPattern.FindAllString(value, -1), "") != value {
+			return 0, invalid
+		}
+		units := map[string]int64{"d": 24 * 3600, "h": 3600, "m": 60, "s": 1}
+		for _, m := range matched {
+			n, _ := strconv.ParseInt(m[1], 10, 64)
+			seconds += n * units[m[2]]
+		}
+	} else {
+		var days, hours, minutes int64
+		var err error
+
+		clock := value
+		if i := strings.Index(value, "-"); i >= 0 {
+			days, err = strconv.ParseInt(value[:i], 10, 64)
+			if err != nil || days < 0 {
+				return 0, invalid
+			}
+			clock = value[i+1:]
+		}
+
+		fields := strings.Split(clock, ":")
+		var parts = make([]int64, len(fields))
+		for i, f := range fields {
+			parts[i], err = strconv.ParseInt(f, 10, 64)
+			if err != nil || parts[i] < 0 {
+				return 0, invalid
+			}
+		}
+
+		if clock != value {
+			// days-hours[:minutes[:seconds]]
+			switch len(parts) {
+			case 3:
+				seconds = parts[2]
+				fallthrough
+			case 2:
+				minutes = parts[1]
+				fallthrough
+			case 1:
+				hours = parts[0]
+			default:
+				return 0, invalid
+			}
+		} else {
+			switch len(parts) {
+			case 1:
+				minutes = parts[0]
+			case 2:
+				minutes, seconds = parts[0], parts[1]
+			case 3:
+				hours, minutes, seconds = parts[0], parts[1], parts[2]
+			default:
+				return 0, invalid
+			}
+		}
+		// Only the leading field may go past its usual range.
+		var overflow = len(parts) > 1 && seconds >= 60
+		if clock != value {
+			overflow = overflow || hours >= 24 || minutes >= 60
+		} else if len(parts) == 3 {
+			overflow = overflow || minutes >= 60
+		}
+		if overflow {
+			return 0, invalid
+		}
+		seconds += days*24*3600 + hours*3600 + minutes*60
+	}
+
+	if seconds <= 0 {
+		return 0, fmt.Errorf(`resource error: wall time "%s" must be more than zero`, value)
+	}
+	return WallTime(seconds), nil
+}
+
+/* ---
+ * Format the wall time for Slurm, e.g. 2-00:00:00 or 04:30:00.
+ * --- */
+func (t WallTime) String() string {
+	days := int64(t) / (24 * 3600)
+	rest := int64(t) % (24 * 3600)
+	clock := fmt.Sprintf("%02d:%02d:%02d", rest/3600, rest%3600/60, rest%60)
+	if days > 0 {
+		return fmt.Sprintf("%d-%s", days, clock)
+	}
+	return clock
+}
+
+/* ---
+ * Format the wall time as hours:minutes:seconds, which SGE reads for h_rt.
+ * Hours may go past 24.
+ * --- */
+func (t WallTime) HMS() string {
+	return fmt.Sprintf("%02d:%02d:%02d", int64(t)/3600, int64(t)%3600/60, int64(t)%60)
+}
+
+// Unset values are written as an empty string.
+func (t WallTime) MarshalText() ([]byte, error) {
+	if t == 0 {
+		return []byte{}, nil
+	}
+	return []byte(t.String()), nil
+}
+
+func (t *WallTime) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*t = 0
+		return nil
+	}
+	parsed, err := ParseWallTime(string(text))
+	*t = parsed
+	return err
+}
@@ -0,0 +1,172 @@
+package datamodels
+
+import "testing"
+
+func TestParseMemory(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  Memory
+		valid bool
+	}{
+		{"500", 500, true},
+		{"500M", 500, true},
+		{"500MB", 500, true},
+		{"16G", 16 * 1024, true},
+		{"16g", 16 * 1024, true},
+		{"1.5G", 1536, true},
+		{"1T", 1024 * 1024, true},
+		{"2048K", 2, true},
+		{"1K", 1, true},
+		{" 4G ", 4096, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"0G", 0, false},
+		{"-1G", 0, false},
+		{"16GiB", 0, false},
+		{"16 gigs", 0, false},
+		{"G", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMemory(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseMemory(%q) error = %v, want valid %v", tt.value, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMemory(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryString(t *testing.T) {
+	var tests = []struct {
+		memory Memory
+		want   string
+	}{
+		{500, "500M"},
+		{1500, "1500M"},
+		{1024, "1G"},
+		{16 * 1024, "16G"},
+		{1024 * 1024, "1T"},
+		{0, "0M"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.memory.String(); got != tt.want {
+			t.Errorf("Memory(%d).String() = %q, want %q", tt.memory, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryPer(t *testing.T) {
+	var tests = []struct {
+		memory Memory
+		n      int64
+		want   Memory
+	}{
+		{4096, 4, 1024},
+		{1000, 3, 334},
+		{1000, 1, 1000},
+		{1000, 0, 1000},
+	}
+
+	for _, tt := range tests {
+		if got := tt.memory.Per(tt.n); got != tt.want {
+			t.Errorf("Memory(%d).Per(%d) = %d, want %d", tt.memory, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestParseWallTime(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  WallTime
+		valid bool
+	}{
+		// Slurm formats.
+		{"90", 90 * 60, true},
+		{"90:30", 90*60 + 30, true},
+		{"04:00:00", 4 * 3600, true},
+		{"48:00:00", 48 * 3600, true},
+		{"2-00:00:00", 2 * 24 * 3600, true},
+		{"1-12", 36 * 3600, true},
+		{"1-12:30", 36*3600 + 30*60, true},
+		{"7-00:00:00", 7 * 24 * 3600, true},
+		// Units.
+		{"36h", 36 * 3600, true},
+		{"1h30m", 90 * 60, true},
+		{"2d", 2 * 24 * 3600, true},
+		{"45s", 45, true},
+		// Rejected.
+		{"", 0, false},
+		{"0", 0, false},
+		{"00:00:00", 0, false},
+		{"12:61", 0, false},
+		{"01:60:00", 0, false},
+		{"1-24:00:00", 0, false},
+		{"1:2:3:4", 0, false},
+		{"-5", 0, false},
+		{"1h30", 0, false},
+		{"two hours", 0, false},
+		{"1.5h", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseWallTime(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseWallTime(%q) error = %v, want valid %v", tt.value, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseWallTime(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestWallTimeFormat(t *testing.T) {
+	var tests = []struct {
+		time  WallTime
+		slurm string
+		hms   string
+	}{
+		{90 * 60, "01:30:00", "01:30:00"},
+		{4*3600 + 5, "04:00:05", "04:00:05"},
+		{2 * 24 * 3600, "2-00:00:00", "48:00:00"},
+		{36*3600 + 30*60, "1-12:30:00", "36:30:00"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.time.String(); got != tt.slurm {
+			t.Errorf("WallTime(%d).String() = %q, want %q", tt.time, got, tt.slurm)
+		}
+		if got := tt.time.HMS(); got != tt.hms {
+			t.Errorf("WallTime(%d).HMS() = %q, want %q", tt.time, got, tt.hms)
+		}
+		// Formatted times parse back to the same value.
+		if parsed, err := ParseWallTime(tt.time.String()); err != nil || parsed != tt.time {
+			t.Errorf("ParseWallTime(%q) = %d, %v, want %d", tt.time.String(), parsed, err, tt.time)
+		}
+	}
+}
+
+func TestQuantityText(t *testing.T) {
+	var memory Memory
+	if err := memory.UnmarshalText([]byte("")); err != nil || memory != 0 {
+		t.Errorf("Memory.UnmarshalText(\"\") = %d, %v, want 0", memory, err)
+	}
+	if err := memory.UnmarshalText([]byte("16G")); err != nil || memory != 16*1024 {
+		t.Errorf("Memory.UnmarshalText(\"16G\") = %d, %v, want %d", memory, err, 16*1024)
+	}
+	if text, _ := Memory(0).MarshalText(); string(text) != "" {
+		t.Errorf("Memory(0).MarshalText() = %q, want empty", text)
+	}
+
+	var wallTime WallTime
+	if err := wallTime.UnmarshalText([]byte("nonsense")); err == nil {
+		t.Errorf("WallTime.UnmarshalText(\"nonsense\") gave no error")
+	}
+	if text, _ := WallTime(3600).MarshalText(); string(text) != "01:00:00" {
+		t.Errorf("WallTime(3600).MarshalText() = %q, want %q", text, "01:00:00")
+	}
+}
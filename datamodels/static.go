@@ -10,8 +10,12 @@ var SLURM_PREAMBLE = map[string]string{
 	"email":         "#SBATCH --mail-user=%s",
 	"tasks":         "#SBATCH --ntasks=%d",
 	"cpus":          "#SBATCH --cpus-per-task=%d",
-	"memory":        "#SBATCH --mem=%d",
+	"memory":        "#SBATCH --mem=%s",
 	"time":          "#SBATCH --time=%s",
+	"account":       "#SBATCH --account=%s",
+	"qos":           "#SBATCH --qos=%s",
+	"constraint":    "#SBATCH --constraint=%s",
+	"exclusive":     "#SBATCH --exclusive",
 	"job_log":       "#SBATCH --output=%s_%%j.log",
 }
 
@@ -23,14 +27,43 @@ var SGE_PREAMBLE = map[string]string{
 	"email":                "#$ -M %s -m be",
 	"parallel_environment": "#$ -pe %s",
 	"memory":               "#$ -l %s",
+	"time":                 "#$ -l h_rt=%s",
 }
 
+// The SGE resource memory is requested as when the sge_preamble names none.
+// h_vmem is a limit per slot.
+const SGE_MEMORY_RESOURCE = "h_vmem"
+
 var COMMAND_PREAMBLE = map[string]string{
-	"job_name": "#SBATCH --job-name=%s",
-	"tasks":    "#SBATCH --ntasks=%d",
-	"cpus":     "#SBATCH --cpus-per-task=%d",
-	"memory":   "#SBATCH --mem=%d",
-	"time":     "#SBATCH --time=%s",
+	"job_name":   "#SBATCH --job-name=%s",
+	"tasks":      "#SBATCH --ntasks=%d",
+	"cpus":       "#SBATCH --cpus-per-task=%d",
+	"memory":     "#SBATCH --mem=%s",
+	"time":       "#SBATCH --time=%s",
+	"partition":  "#SBATCH --partition=%s",
+	"account":    "#SBATCH --account=%s",
+	"qos":        "#SBATCH --qos=%s",
+	"constraint": "#SBATCH --constraint=%s",
+	"exclusive":  "#SBATCH --exclusive",
+}
+
+// Options that give srun and sbatch the per-step settings of a command on
+// the command line.
+var STEP_OPTIONS = map[string]string{
+	"job_name":   "-J %s",
+	"tasks":      "--ntasks=%d",
+	"cpus":       "--cpus-per-task=%d",
+	"memory":     "--mem-per-cpu=%s",
+	"time":       "--time=%s",
+	"partition":  "--partition=%s",
+	"account":    "--account=%s",
+	"qos":        "--qos=%s",
+	"constraint": "--constraint=%s",
+	"exclusive":  "--exclusive",
+	"mail_type":  "--mail-type=%s",
+	"mail_user":  "--mail-user=%s",
+	"output":     "--output=%s",
+	"dependency": "--dependency=afterok:%s",
 }
 
 var INTERMEDIATE_SLURM_SHIT = []string{
@@ -70,11 +103,44 @@ var INTERMEDIATE_SGE_SHIT = []string{
 }
 
 var JOB_SHIT = map[string]string{
-	"singularity_cmd":     "singularity run \\",
-	"singularity_bind":    "--bind %s \\",
-	"singularity_workdir": "-W %s \\",
-	"singularity_env":     "%s/%s \\",
-	"command":             "%s \\",
+	"singularity_cmd":      "%s %s \\",
+	"singularity_bind":     "--bind %s \\",
+	"singularity_workdir":  "-W %s \\",
+	"singularity_cleanenv": "--cleanenv \\",
+	"singularity_contain":  "--contain \\",
+	"singularity_gpu":      "--nv \\",
+	"singularity_env":      "--env \"%s\" \\",
+	"singularity_overlay":  "--overlay %s \\",
+	"docker_cmd":           "%s run --rm \\",
+	"docker_user":          "-u $(id -u):$(id -g) \\",
+	"podman_user":          "--userns=keep-id \\",
+	"docker_volume":        "-v %s \\",
+	"docker_workdir":       "-w %s \\",
+	"docker_entrypoint":    "--entrypoint= \\",
+	"docker_gpu":           "--gpus all \\",
+	"docker_env":           "-e \"%s\" \\",
+	"container_option":     "%s \\",
+	"container_image":      "%s \\",
+	"command":              "%s \\",
+}
+
+// Lines that prepare the host environment of a step before the tool runs.
+var ENVIRONMENT_SHIT = map[string]string{
+	"module_load":    "module load %s",
+	"conda_init":     `source "$(conda info --base)/etc/profile.d/conda.sh"`,
+	"conda_create":   "mkdir -p %s && flock %s.lock bash -c '[ -d %s ] || conda env create --prefix %s --file %s'",
+	"conda_activate": "conda activate %s",
+}
+
+// Name of the file a step script touches once the step completes.
+const SENTINEL_FILE = ".commander_done"
+
+// Lines appended after every step command. The command above ends with a
+// line continuation, so the leading blank line terminates it.
+var STEP_SENTINEL = map[string]string{
+	"status": "\nrc=$?",
+	"touch":  "if [ $rc -eq 0 ]; then mkdir -p %s && touch %s; fi",
+	"exit":   "exit $rc",
 }
 
 var HELP_MSG = `
@@ -93,22 +159,157 @@ var HELP_MSG = `
 	--preflight:	Tells commander to run sanity checks before generating pipeline scripts.
 			Preflight checks include the following:
 			- Existence of sample file directory and sample files,
+			- Sample file checksums, with --verify-checksums,
+			- Sample file content, with --fastq-check,
+			- Free disk space and inodes. The output of every step is estimated from
+			  the size of the sample files and compared with the free space on the
+			  filesystem it is written to. Each filesystem is checked for its share,
 			- Existence of analysis output directory,
-			- Analysis output directory permissions. 
+			- Analysis output directory permissions,
+			- Resources of every step against the "cluster_file", see Cluster description,
+			- Existence of the reference index files of steps that name a "reference"
+			  from the "reference_registry",
+			- Container image checksums. Images given as docker://, library:// or oras://
+			  URIs are pulled into the container image_dir when one is set. The resolved
+			  images are recorded in <path_to_analysis_dir>/config/images.json.
 	
-			A missing sample file directory or sample file will cause commander to terminate.
+			Every check runs even when an earlier one fails, and ends as pass, warn, fail
+			or skip. A summary table of all checks is printed at the end, and commander
+			terminates if any check failed. A missing sample file directory only warns.
+			The working directory, when set, is checked and created like the analysis directory.
 			In the case of a missing output directory, commander will try to create the directory
 			on the user's behalf.
-			** At this time, no consideration is given for overwriting existing output. **
+			Commander stops if the step output directories already hold files from an
+			earlier run and lists them. Pass --resume, --overwrite or --increment-analysis-id
+			to continue.
 
 			As part of the preflight checks, commander will also create the following directories:
-			<path_to_analysis_dir>/conf
+			<path_to_analysis_dir>/config
 			<path_to_analysis_dir>/logs
 
 			Commander will archive the supplied parameter file and any accompanying design files 
-			under <path_to_analysis_dir>/conf. All job log files (e.g., those produced by slurm or sge)
+			under <path_to_analysis_dir>/config. All job log files (e.g., those produced by slurm or sge)
 			will be written to <path_to_analysis_dir>/logs.
 
+	--resume:	Tells commander to skip steps that already completed. Every step script
+			touches a sentinel file in the step output directory when the step succeeds.
+			A step (or sample of a batch step) is skipped when its sentinel exists and
+			is newer than its inputs. Steps downstream of a step that reruns also rerun.
+			Without an "analysis_id" or the "hash" strategy, the latest analysis
+			generated from the same parameter file is resumed.
+
+	--force-step:	Comma separated list of step names to rerun even if they completed.
+			Steps downstream of a forced step also rerun. Requires --resume.
+
+	--dry-run:	Tells commander to show what it would do without touching the filesystem.
+			Planned directory creations are listed, new files are printed in full and
+			existing files are shown as a diff against what would be written. The
+			command that would submit the job is printed last.
+
+	--verify-checksums:
+			Tells preflight to hash every sample file and compare it to its expected
+			md5 or sha256. Checksums are read from md5=<R1>,<R2> or sha256=<R1>,<R2>
+			columns in the samples file, or from md5sum.txt or sha256sum.txt in the
+			sample directory. Files are hashed in parallel. Results are cached by file
+			size and modification time, so unchanged files are not hashed again.
+
+	--fastq-check:	Tells preflight how thoroughly to read the sample files: off (default),
+			quick or full. Quick reads the first 10000 reads of every file, full reads
+			every file to the end. Files are checked for being empty, truncated or not
+			gzip compressed when named .gz, and for malformed records. The quality
+			encoding is detected. Paired files must agree on read names, quality
+			encoding and (in full mode) read count. Problems are reported per sample.
+
+	--preflight-json:
+			Write the preflight results as JSON to the given file.
+	--preflight-junit:
+			Write the preflight results as JUnit XML to the given file, so CI can gate
+			changes to parameter files. With --dry-run both reports are printed instead.
+
+	--overwrite:	Allows preflight to continue when the analysis already has output.
+			Needs an "analysis_id" or the "hash" strategy, since other generated
+			IDs never point at existing output.
+
+	--increment-analysis-id:
+			Uses the next free analysis ID when the analysis directory already has
+			content. A trailing number in the ID is incremented (run1 becomes run2),
+			otherwise _2 is appended.
+
+	--outdir:	Directory the generated job script and step scripts are written to.
+			Defaults to <path_to_analysis_dir>/scripts. The job script calls the step
+			scripts by absolute path, so it can be submitted from any directory.
+
+	Resources:
+	Memory is a number of megabytes or a quantity with a unit, e.g. "500M", "16G" or "1.5T".
+	Units are powers of 1024. Wall time is a Slurm time ("90", "04:00:00", "2-00:00:00") or
+	a time with units ("36h", "1h30m", "2d"). Nonsense values stop commander.
+		- The "memory" of a step is per CPU. It is passed to Slurm as --mem-per-cpu.
+		  A job of a single non-batch command is the exception: its "memory" is for the
+		  whole job and is passed to Slurm as --mem.
+		- The "memory" of the sge_preamble is either resource requests per slot, e.g.
+		  "virtual_free=4G" or "h_vmem=4G,mem_free=4G", or the memory of the whole job,
+		  e.g. "64G", which is requested per slot of the parallel_environment as h_vmem.
+		  The first memory request is the memory of the job. Requests other than
+		  memory are passed on as they are.
+		- The optional "wall_time" of the sge_preamble is requested as h_rt.
+
+	Step settings:
+	Besides "tasks", "cpus" and "memory", a command may set "time", "partition", "account",
+	"qos", "constraint" and "exclusive". The slurm_preamble "wall_time", "partition",
+	"account", "qos", "constraint" and "exclusive" are the defaults for every step.
+	The "submission_mode" of the job_details block decides how they are used:
+		- "single" (default): the whole pipeline runs as one job. Steps pass their time,
+		  constraint and exclusive settings to srun. A step partition, account or qos is
+		  ignored with a warning, since the steps share the job's allocation. A job of a
+		  single non-batch command is the exception: all of its settings are written to
+		  the job script and override the slurm_preamble.
+		- "separate": every step, and every sample of a batch step, is submitted as its own
+		  job with all of its settings. commander writes <job_name>_submit.sh, which is run
+		  with bash and submits the jobs with sbatch. Each job waits (afterok) on the jobs of
+		  the steps it takes input from. A batch step waits on the same sample of a batch
+		  input step only, so the pipeline_mode does not matter. Job logs are written to
+		  <path_to_analysis_dir>/logs. Only supported with --slurm.
+
+	Cluster description:
+	With --slurm, a top-level "cluster_file" in the parameter file names a description of the
+	cluster. Preflight fails when a partition does not exist, a wall time is over the
+	partition time limit, or a step asks for more CPUs (cpus x tasks) or memory
+	(memory x cpus x tasks, see Resources) than a node of the partition has. Steps are
+	checked against their own partition and time with submission_mode "separate" or when the
+	job is a single non-batch command, and against the job's otherwise. The smallest partition that fits a step is suggested. The file is JSON,
+		{"partitions": [{"name": "short", "max_cpus": 32, "max_memory": "125G",
+		                 "max_time": "04:00:00", "nodes": ["c01", "c02"]}]}
+	or the saved output of "scontrol show partition" or of sinfo -o "%P %c %m %l %N".
+	Limits that are missing or zero are not checked.
+
+	Analysis IDs:
+	Analyses are written to <analysis_path>/<pi>/<experiment_name>/<analysis_id>. When the
+	parameter file gives no "analysis_id", one is generated with the "analysis_id_strategy"
+	of the experiment_details block:
+			- "timestamp" (default): the generation time, e.g. 20240131-154500,
+			- "hash": a short hash of the resolved parameters and samples,
+			- "counter": the next number of a counter kept in the experiment directory.
+	The chosen ID is printed and recorded in <analysis_path>/<pi>/<experiment_name>/analyses.tsv.
+
+	Subcommands:
+	commander list <param_file>:	Show the analyses generated for the experiment of the parameter file.
+	commander package <analysis_dir>:
+			Describe a finished analysis as an RO-Crate by writing ro-crate-metadata.json
+			to the analysis directory. The crate covers the workflow steps, tools and
+			containers, the input samples, the archived configuration, the generated
+			scripts and the step output directories. It is built from
+			config/manifest.json and works offline.
+	commander tune [--write <new_param_file>] <param_file> [<analysis_dir>...]:
+			Recommend the cpus, memory and time of every step from earlier runs. Reads
+			the logs directory of the given analyses, or of every analysis of the
+			experiment, for saved "sacct --parsable" output (JobID, JobName, State,
+			Elapsed, TotalCPU, AllocCPUS and MaxRSS columns), "qacct -j" output and
+			/usr/bin/time -v output. Runs are matched to steps by job name, e.g.
+			STAR_A, or by the name of the time -v file, e.g. STAR_A_1234.log. Only
+			completed runs count. CPUs are the most a step kept busy, memory is the
+			peak use plus 20%, split per CPU, and time is the longest run plus 50%.
+			--write saves a copy of a JSON parameter file with the recommendations.
+
 	Arguments:
 	A single parameter file that defines the workflow to be executed. This file is expected to conform to the JSON 
 	specification.
@@ -122,9 +323,19 @@ var HELP_MSG = `
 	commander --sge --preflight commander_test_params.json
 
 	Output:
+	Every run writes a provenance manifest to <path_to_analysis_dir>/config/manifest.json.
+	It records the commander version, host, user and time of generation, the resolved job,
+	the container images and their digests, checksums of the parameter and design files,
+	the size and modification time of every sample file (with its sha256 once verified)
+	and the sha256 of every script.
+
 	If the --slurm option is provided, commander will produce a main .slurm file that can
-	be submitted to a Slurm cluster using sbatch.
+	be submitted to a Slurm cluster using sbatch. With submission_mode "separate" it produces
+	a <job_name>_submit.sh that is run with bash instead.
 
 	If the --sge options is provided, commander will produce a main .sh file that can be
 	submitted to a SGE cluster using qsub.
+
+	All scripts are written to the --outdir directory, <path_to_analysis_dir>/scripts
+	by default.
 `
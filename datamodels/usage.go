@@ -0,0 +1,38 @@
+package datamodels
+
+// Resource usage of one run of a step, read from scheduler accounting or from
+// /usr/bin/time -v output. Unknown values are zero.
+type UsageRecord struct {
+	// Job or job step name, e.g. STAR_A.
+	Name string
+	// Step the run belongs to, set once the name is matched.
+	Step       string
+	CPUs       int64
+	Elapsed    float64
+	CPUSeconds float64
+	MaxRSS     Memory
+	Source     string
+}
+
+// Resources recommended for a step from its past runs. Memory is as in the
+// parameter file: per CPU, or for the whole job of a single non-batch command.
+type Recommendation struct {
+	Step          string
+	Runs          int
+	CPUs          int64
+	Memory        Memory
+	WallTime      WallTime
+	PeakMemory    Memory
+	MaxElapsed    float64
+	CPUEfficiency float64
+}
+
+/* ---
+ * Return the average number of CPUs busy during the run.
+ * --- */
+func (u *UsageRecord) CPUsUsed() float64 {
+	if u.Elapsed <= 0 {
+		return 0
+	}
+	return u.CPUSeconds / u.Elapsed
+}
@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"commander/datamodels"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kinds of usage files found in the logs directory of an analysis.
+const (
+	USAGE_SACCT   = "sacct"
+	USAGE_QACCT   = "qacct"
+	USAGE_TIME_V  = "time -v"
+	USAGE_UNKNOWN = ""
+)
+
+// sacct rows for the parts of a job that carry its usage rather than a name.
+var SACCT_SUBSTEPS = map[string]bool{"batch": true, "extern": true}
+
+// The job ID Slurm appends to log names, e.g. STAR_A_123456.log.
+var logJobID = regexp.MustCompile(`_[0-9]+$`)
+
+/* -----------------------------------------------------------------------------
+ * Parsing accounting data of earlier runs.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Tell what kind of usage a file holds from its content.
+ * --- */
+func UsageFileKind(content []byte) string {
+	firstLine := strings.SplitN(string(content), "\n", 2)[0]
+	switch {
+	case strings.Contains(firstLine, "|") && strings.Contains(firstLine, "JobID"):
+		return USAGE_SACCT
+	case bytes.Contains(content, []byte("ru_wallclock")):
+		return USAGE_QACCT
+	case bytes.Contains(content, []byte("Maximum resident set size")):
+		return USAGE_TIME_V
+	}
+	return USAGE_UNKNOWN
+}
+
+/* ---
+ * Read every usage file in a directory. Files holding no usage, such as
+ * ordinary job logs, are skipped. /usr/bin/time -v output is named after the
+ * file it was found in, less the extension and any Slurm job ID.
+ * --- */
+func ReadUsageDir(dir string) ([]datamodels.UsageRecord, error) {
+	var records = make([]datamodels.UsageRecord, 0)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return records, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return records, err
+		}
+
+		var parsed []datamodels.UsageRecord
+		switch UsageFileKind(content) {
+		case USAGE_SACCT:
+			parsed, err = ParseSacct(bytes.NewReader(content))
+		case USAGE_QACCT:
+			parsed, err = ParseQacct(bytes.NewReader(content))
+		case USAGE_TIME_V:
+			name := strings.SplitN(entry.Name(), ".", 2)[0]
+			parsed, err = ParseTimeVerbose(bytes.NewReader(content), logJobID.ReplaceAllString(name, ""))
+		default:
+			continue
+		}
+		if err != nil {
+			return records, err
+		}
+		for i := range parsed {
+			parsed[i].Source = path
+		}
+		records = append(records, parsed...)
+	}
+	return records, nil
+}
+
+/* ---
+ * Parse the output of sacct --parsable or --parsable2, e.g. from
+ * sacct -j <id> --parsable2 --format=JobID,JobName,State,Elapsed,TotalCPU,AllocCPUS,MaxRSS
+ * The JobID and JobName columns are required. Usage reported on the batch and
+ * extern parts of a job is added to the job. Only completed runs are kept.
+ * --- */
+func ParseSacct(r io.Reader) ([]datamodels.UsageRecord, error) {
+	var records = make([]datamodels.UsageRecord, 0)
+	var index = make(map[string]int)
+	var states = make([]string, 0)
+	var columns = make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return records, scanner.Err()
+	}
+	for i, name := range strings.Split(scanner.Text(), "|") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"JobID", "JobName"} {
+		if _, ok := columns[required]; !ok {
+			return records, errors.New("accounting error: sacct output has no " + required + " column")
+		}
+	}
+
+	column := func(fields []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+		}
+		return ""
+	}
+
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) < 2 {
+			continue
+		}
+		id := column(fields, "JobID")
+		usage := datamodels.UsageRecord{
+			Name:       column(fields, "JobName"),
+			CPUs:       parseCount(column(fields, "AllocCPUS", "NCPUS")),
+			Elapsed:    parseClockSeconds(column(fields, "Elapsed")),
+			CPUSeconds: parseClockSeconds(column(fields, "TotalCPU")),
+			MaxRSS:     parseUsageMemory(column(fields, "MaxRSS")),
+		}
+
+		if SACCT_SUBSTEPS[usage.Name] {
+			parent, ok := index[strings.SplitN(id, ".", 2)[0]]
+			if !ok {
+				continue
+			}
+			if usage.MaxRSS > records[parent].MaxRSS {
+				records[parent].MaxRSS = usage.MaxRSS
+			}
+			if records[parent].CPUSeconds == 0 {
+				records[parent].CPUSeconds = usage.CPUSeconds
+			}
+			continue
+		}
+
+		index[id] = len(records)
+		records = append(records, usage)
+		states = append(states, column(fields, "State"))
+	}
+
+	var completed = make([]datamodels.UsageRecord, 0)
+	for i, usage := range records {
+		if states[i] == "" || strings.HasPrefix(states[i], "COMPLETED") {
+			completed = append(completed, usage)
+		}
+	}
+	return completed, scanner.Err()
+}
+
+/* ---
+ * Parse the output of SGE qacct -j. Every job is a block of "key value" lines
+ * starting with a line of "=". Only jobs that exited cleanly are kept.
+ * --- */
+func ParseQacct(r io.Reader) ([]datamodels.UsageRecord, error) {
+	var records = make([]datamodels.UsageRecord, 0)
+	var fields map[string]string
+
+	flush := func() {
+		if fields == nil || fields["jobname"] == "" {
+			return
+		}
+		if fields["exit_status"] != "0" || !strings.HasPrefix(fields["failed"], "0") {
+			return
+		}
+		records = append(records, datamodels.UsageRecord{
+			Name:       fields["jobname"],
+			CPUs:       parseCount(fields["slots"]),
+			Elapsed:    parseSeconds(fields["ru_wallclock"]),
+			CPUSeconds: parseSeconds(fields["cpu"]),
+			MaxRSS:     parseUsageMemory(fields["maxvmem"]),
+		})
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "====") {
+			flush()
+			fields = make(map[string]string)
+			continue
+		}
+		kv := strings.Fields(line)
+		if fields == nil || len(kv) < 2 {
+			continue
+		}
+		fields[kv[0]] = strings.Join(kv[1:], " ")
+	}
+	flush()
+	return records, scanner.Err()
+}
+
+/* ---
+ * Parse the output of /usr/bin/time -v. A file may hold several runs, each
+ * starting with "Command being timed". The CPUs given to the run are unknown.
+ * --- */
+func ParseTimeVerbose(r io.Reader, name string) ([]datamodels.UsageRecord, error) {
+	var records = make([]datamodels.UsageRecord, 0)
+	var current *datamodels.UsageRecord
+	var userTime, systemTime float64
+	var exitStatus = "0"
+
+	flush := func() {
+		if current == nil {
+			return
+		}
+		current.CPUSeconds = userTime + systemTime
+		if exitStatus == "0" {
+			records = append(records, *current)
+		}
+		current = nil
+		userTime, systemTime, exitStatus = 0, 0, "0"
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], strings.TrimSpace(kv[1])
+
+		if key == "Command being timed" || current == nil {
+			flush()
+			current = &datamodels.UsageRecord{Name: name}
+		}
+		switch {
+		case key == "User time (seconds)":
+			userTime = parseSeconds(value)
+		case key == "System time (seconds)":
+			systemTime = parseSeconds(value)
+		case strings.HasPrefix(key, "Elapsed (wall clock) time"):
+			current.Elapsed = parseClockSeconds(value)
+		case key == "Maximum resident set size (kbytes)":
+			current.MaxRSS = parseUsageMemory(value + "K")
+		case key == "Exit status":
+			exitStatus = value
+		}
+	}
+	flush()
+	return records, scanner.Err()
+}
+
+/* ---
+ * Parse a duration written as [days-][hours:]minutes:seconds[.fraction], as
+ * sacct and /usr/bin/time write them. Unparseable durations give zero.
+ * --- */
+func parseClockSeconds(value string) float64 {
+	var days float64
+	if i := strings.Index(value, "-"); i >= 0 {
+		days, _ = strconv.ParseFloat(value[:i], 64)
+		value = value[i+1:]
+	}
+
+	var seconds float64
+	for _, field := range strings.Split(value, ":") {
+		n, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return days*24*3600 + seconds
+}
+
+/* ---
+ * Parse a number of seconds, e.g. 123.45 or 123.450s as qacct writes them.
+ * --- */
+func parseSeconds(value string) float64 {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "s"), 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func parseCount(value string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+/* ---
+ * Parse reported memory use, e.g. 123456K or 1.5G. Missing or zero usage
+ * gives zero.
+ * --- */
+func parseUsageMemory(value string) datamodels.Memory {
+	memory, err := datamodels.ParseMemory(value)
+	if err != nil {
+		return 0
+	}
+	return memory
+}
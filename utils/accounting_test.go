@@ -0,0 +1,234 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func openFixture(t *testing.T, name string) *os.File {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseSacct(t *testing.T) {
+	const header = "JobID|JobName|State|Elapsed|TotalCPU|AllocCPUS|MaxRSS\n"
+	var tests = []struct {
+		name    string
+		input   string
+		records []datamodels.UsageRecord
+		err     string
+	}{
+		{
+			name:  "batch and extern merged into the job",
+			input: header + "1|STAR_A|COMPLETED|01:00:00||8|\n1.batch|batch|COMPLETED|01:00:00|05:00:00|8|20G\n1.extern|extern|COMPLETED|01:00:00|00:00:01|8|21G\n",
+			records: []datamodels.UsageRecord{
+				{Name: "STAR_A", CPUs: 8, Elapsed: 3600, CPUSeconds: 18000, MaxRSS: 21 * 1024},
+			},
+		},
+		{
+			name:  "job CPU time kept over the batch step",
+			input: header + "1|STAR_A|COMPLETED|01:00:00|06:00:00|8|\n1.batch|batch|COMPLETED|01:00:00|05:00:00|8|20G\n",
+			records: []datamodels.UsageRecord{
+				{Name: "STAR_A", CPUs: 8, Elapsed: 3600, CPUSeconds: 21600, MaxRSS: 20 * 1024},
+			},
+		},
+		{
+			name:    "sub-step without a job",
+			input:   header + "1.batch|batch|COMPLETED|01:00:00|05:00:00|8|20G\n",
+			records: []datamodels.UsageRecord{},
+		},
+		{
+			name: "only completed runs kept",
+			input: header +
+				"1|fastqc_A|COMPLETED|00:10:00|00:05:00|1|100M\n" +
+				"2|fastqc_B|FAILED|00:10:00|00:05:00|1|100M\n" +
+				"3|fastqc_C|CANCELLED by 1000|00:10:00|00:05:00|1|100M\n" +
+				"4|fastqc_D|TIMEOUT|00:10:00|00:05:00|1|100M\n" +
+				"5|fastqc_E|OUT_OF_MEMORY|00:10:00|00:05:00|1|100M\n" +
+				"6|fastqc_F|RUNNING|00:10:00|00:05:00|1|\n",
+			records: []datamodels.UsageRecord{
+				{Name: "fastqc_A", CPUs: 1, Elapsed: 600, CPUSeconds: 300, MaxRSS: 100},
+			},
+		},
+		{
+			name:  "no state column keeps every run",
+			input: "JobID|JobName|Elapsed\n1|fastqc_A|00:10:00\n",
+			records: []datamodels.UsageRecord{
+				{Name: "fastqc_A", Elapsed: 600},
+			},
+		},
+		{
+			name:  "parsable with trailing separator",
+			input: "JobID|JobName|State|NCPUS|\n1|fastqc_A|COMPLETED|4|\n",
+			records: []datamodels.UsageRecord{
+				{Name: "fastqc_A", CPUs: 4},
+			},
+		},
+		{
+			name:  "no job name column",
+			input: "JobID|State\n1|COMPLETED\n",
+			err:   "no JobName column",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := ParseSacct(strings.NewReader(tt.input))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseSacct() error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSacct() error = %v", err)
+			}
+			if !reflect.DeepEqual(records, tt.records) {
+				t.Errorf("ParseSacct() = %+v, want %+v", records, tt.records)
+			}
+		})
+	}
+}
+
+func TestParseSacctFile(t *testing.T) {
+	records, err := ParseSacct(openFixture(t, "sacct.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []datamodels.UsageRecord{
+		{Name: "STAR_A", CPUs: 8, Elapsed: 3600, CPUSeconds: 21600, MaxRSS: 26 * 1024},
+		{Name: "fastqc_trimmed_A", CPUs: 1, Elapsed: 600, CPUSeconds: 480.5, MaxRSS: 1954},
+		{Name: "samtools_index_B", CPUs: 1, Elapsed: 93784, CPUSeconds: 86400, MaxRSS: 512},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("ParseSacct() = %+v, want %+v", records, want)
+	}
+}
+
+func TestParseQacctFile(t *testing.T) {
+	records, err := ParseQacct(openFixture(t, "qacct.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trim_galore_B failed and is dropped.
+	want := []datamodels.UsageRecord{
+		{Name: "trim_galore_A", CPUs: 2, Elapsed: 600, CPUSeconds: 550.5, MaxRSS: 1024},
+		{Name: "fastqc_B", CPUs: 1, Elapsed: 300, CPUSeconds: 240.25, MaxRSS: 500},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("ParseQacct() = %+v, want %+v", records, want)
+	}
+}
+
+func TestParseTimeVerboseFile(t *testing.T) {
+	records, err := ParseTimeVerbose(openFixture(t, "STAR_A_4242.time"), "STAR_A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second run exited with 1 and is dropped.
+	want := []datamodels.UsageRecord{
+		{Name: "STAR_A", Elapsed: 3605, CPUSeconds: 21600, MaxRSS: 26 * 1024},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("ParseTimeVerbose() = %+v, want %+v", records, want)
+	}
+}
+
+func TestUsageFileKind(t *testing.T) {
+	var tests = []struct {
+		file string
+		kind string
+	}{
+		{"sacct.txt", USAGE_SACCT},
+		{"qacct.txt", USAGE_QACCT},
+		{"STAR_A_4242.time", USAGE_TIME_V},
+	}
+
+	for _, tt := range tests {
+		if kind := UsageFileKind(readFixture(t, tt.file)); kind != tt.kind {
+			t.Errorf("UsageFileKind(%s) = %q, want %q", tt.file, kind, tt.kind)
+		}
+	}
+	if kind := UsageFileKind([]byte("Starting STAR\nDone.\n")); kind != USAGE_UNKNOWN {
+		t.Errorf("UsageFileKind(job log) = %q, want %q", kind, USAGE_UNKNOWN)
+	}
+}
+
+func TestReadUsageDir(t *testing.T) {
+	records, err := ReadUsageDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names = make([]string, 0)
+	for _, r := range records {
+		names = append(names, r.Name)
+		if r.Source == "" {
+			t.Errorf("record %s has no source", r.Name)
+		}
+	}
+	// time -v output is named after its file, less the extension and job ID.
+	want := []string{"STAR_A", "trim_galore_A", "fastqc_B", "STAR_A", "fastqc_trimmed_A", "samtools_index_B"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadUsageDir() names = %v, want %v", names, want)
+	}
+}
+
+func TestParseClockSeconds(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  float64
+	}{
+		{"00:10:00", 600},
+		{"1:00:05", 3605},
+		{"10:00.500", 600.5},
+		{"0:02.00", 2},
+		{"1-02:03:04", 93784},
+		{"45", 45},
+		{"", 0},
+		{"Unknown", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseClockSeconds(tt.value); got != tt.want {
+			t.Errorf("parseClockSeconds(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseUsageMemory(t *testing.T) {
+	var tests = []struct {
+		value string
+		want  datamodels.Memory
+	}{
+		{"27262976K", 26 * 1024},
+		{"2000000K", 1954},
+		{"1.000G", 1024},
+		{"500.000M", 500},
+		{"0", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseUsageMemory(tt.value); got != tt.want {
+			t.Errorf("parseUsageMemory(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files kept in the experiment directory. The counter holds the last
+// sequential analysis ID handed out. The index lists every analysis generated
+// for the experiment.
+const ANALYSIS_COUNTER_FILE = ".analysis_counter"
+const ANALYSIS_INDEX_FILE = "analyses.tsv"
+const ANALYSIS_INDEX_HEADER = "analysis_id\tstrategy\tgenerated\tparam_file"
+
+/* -----------------------------------------------------------------------------
+ * Generating, recording and listing analysis IDs.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Give the job an analysis ID if the param file does not set one. The ID is
+ * built with the experiment's analysis_id_strategy. Timestamp and counter IDs
+ * are new on every run, so --resume picks up the latest analysis generated
+ * from the param file instead, and --overwrite is refused.
+ * --- */
+func AssignAnalysisID(job *datamodels.Job, paramFile string) error {
+	experiment := &job.ExperimentDetails
+	if experiment.AnalysisIDStrategy == "" {
+		experiment.AnalysisIDStrategy = datamodels.ANALYSIS_ID_TIMESTAMP
+	}
+	if !datamodels.IsAnalysisIDStrategy(experiment.AnalysisIDStrategy) {
+		return fmt.Errorf(
+			`JSON error: unknown analysis_id_strategy "%s". Use "%s", "%s" or "%s"`,
+			experiment.AnalysisIDStrategy,
+			datamodels.ANALYSIS_ID_TIMESTAMP,
+			datamodels.ANALYSIS_ID_HASH,
+			datamodels.ANALYSIS_ID_COUNTER,
+		)
+	}
+
+	if experiment.AnalysisID != "" {
+		fmt.Printf("Analysis ID: %s\n\n", experiment.AnalysisID)
+		return nil
+	}
+
+	stable := experiment.AnalysisIDStrategy == datamodels.ANALYSIS_ID_HASH
+	if Resume && !stable {
+		id, err := latestAnalysisID(*experiment, paramFile)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return fmt.Errorf(
+				`Analysis ID error. --resume needs an earlier analysis, but %s lists none generated from %s. Set "analysis_id", use analysis_id_strategy "hash" or run once without --resume.`,
+				filepath.Join(experiment.PrintExperimentPath(), ANALYSIS_INDEX_FILE),
+				paramFile,
+			)
+		}
+		experiment.AnalysisID = id
+		fmt.Printf("Analysis ID: %s (latest analysis of %s)\n\n", experiment.AnalysisID, paramFile)
+		return nil
+	}
+	if Overwrite && !stable {
+		return fmt.Errorf(
+			`Analysis ID error. --overwrite has no effect, since analysis_id_strategy "%s" gives a new analysis ID on every run. Set "analysis_id" or use analysis_id_strategy "hash".`,
+			experiment.AnalysisIDStrategy,
+		)
+	}
+
+	switch experiment.AnalysisIDStrategy {
+	case datamodels.ANALYSIS_ID_HASH:
+		id, err := paramsHash(*job)
+		if err != nil {
+			return err
+		}
+		experiment.AnalysisID = id
+	case datamodels.ANALYSIS_ID_COUNTER:
+		id, err := nextCounterID(*experiment)
+		if err != nil {
+			return err
+		}
+		experiment.AnalysisID = id
+	default:
+		experiment.NewAnalysisID()
+	}
+
+	fmt.Printf("Analysis ID: %s (generated from %s)\n\n", experiment.AnalysisID, experiment.AnalysisIDStrategy)
+	return nil
+}
+
+/* ---
+ * Return a short hash of the resolved params, so the same params always map
+ * to the same analysis.
+ * --- */
+func paramsHash(job datamodels.Job) (string, error) {
+	content, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])[:10], nil
+}
+
+/* ---
+ * Hand out the next sequential analysis ID for the experiment.
+ * --- */
+func nextCounterID(experiment datamodels.Experiment) (string, error) {
+	var last = 0
+	counterFile := fmt.Sprintf("%s/%s", experiment.PrintExperimentPath(), ANALYSIS_COUNTER_FILE)
+
+	content, err := ioutil.ReadFile(counterFile)
+	if err == nil {
+		last, err = strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return "", fmt.Errorf("Analysis ID error. Counter file %s is corrupt: %s", counterFile, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err = makeDir(experiment.PrintExperimentPath()); err != nil {
+		return "", err
+	}
+	if err = writeFile(counterFile, []byte(fmt.Sprintf("%d\n", last+1))); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", last+1), nil
+}
+
+/* ---
+ * Return the ID of the latest analysis in the experiment's index generated
+ * from the param file. Empty when there is none.
+ * --- */
+func latestAnalysisID(experiment datamodels.Experiment, paramFile string) (string, error) {
+	indexFile := fmt.Sprintf("%s/%s", experiment.PrintExperimentPath(), ANALYSIS_INDEX_FILE)
+	content, err := ioutil.ReadFile(indexFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	paramPath, err := filepath.Abs(paramFile)
+	if err != nil {
+		return "", err
+	}
+	// Analyses are appended as they are generated, so the last match is the
+	// latest.
+	var id string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 4 && fields[3] == paramPath {
+			id = fields[0]
+		}
+	}
+	return id, nil
+}
+
+/* ---
+ * Add the analysis to the experiment's index. The index records when each
+ * analysis was generated, how its ID was chosen and the param file used.
+ * --- */
+func RecordAnalysisID(experiment datamodels.Experiment, paramFile string) error {
+	indexFile := fmt.Sprintf("%s/%s", experiment.PrintExperimentPath(), ANALYSIS_INDEX_FILE)
+
+	content, err := ioutil.ReadFile(indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) == 0 {
+		content = []byte(ANALYSIS_INDEX_HEADER + "\n")
+	}
+
+	// Regenerating an analysis keeps its original entry.
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.Split(line, "\t")[0] == experiment.AnalysisID {
+			return nil
+		}
+	}
+
+	paramPath, err := filepath.Abs(paramFile)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf(
+		"%s\t%s\t%s\t%s\n",
+		experiment.AnalysisID,
+		experiment.AnalysisIDStrategy,
+		time.Now().Format(time.RFC3339),
+		paramPath,
+	)
+
+	if err = makeDir(experiment.PrintExperimentPath()); err != nil {
+		return err
+	}
+	return writeFile(indexFile, append(content, []byte(line)...))
+}
+
+/* ---
+ * Print the analyses generated for an experiment. Analysis directories that
+ * predate the index are listed too.
+ * --- */
+func ListAnalyses(experiment datamodels.Experiment) error {
+	var recorded = make(map[string]bool)
+	experimentPath := experiment.PrintExperimentPath()
+
+	fmt.Printf("Analyses of %s:\n\n", experimentPath)
+	fmt.Println(ANALYSIS_INDEX_HEADER)
+	content, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", experimentPath, ANALYSIS_INDEX_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if line == "" || line == ANALYSIS_INDEX_HEADER {
+			continue
+		}
+		recorded[strings.Split(line, "\t")[0]] = true
+		fmt.Println(line)
+	}
+
+	entries, err := ioutil.ReadDir(experimentPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !recorded[entry.Name()] {
+			fmt.Printf("%s\t-\t%s\t-\n", entry.Name(), entry.ModTime().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLatestAnalysisID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commander")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	experiment := datamodels.Experiment{PI: "pi", Name: "exp", AnalysisPath: dir}
+	if id, err := latestAnalysisID(experiment, "params.json"); err != nil || id != "" {
+		t.Fatalf("latestAnalysisID() without an index = %q, %v, want empty", id, err)
+	}
+
+	params, _ := filepath.Abs("params.json")
+	other, _ := filepath.Abs("other.json")
+	index := ANALYSIS_INDEX_HEADER + "\n" +
+		fmt.Sprintf("20240101-090000\ttimestamp\t2024-01-01T09:00:00Z\t%s\n", params) +
+		fmt.Sprintf("20240102-090000\ttimestamp\t2024-01-02T09:00:00Z\t%s\n", other) +
+		fmt.Sprintf("20240103-090000\ttimestamp\t2024-01-03T09:00:00Z\t%s\n", params) +
+		fmt.Sprintf("20240104-090000\ttimestamp\t2024-01-04T09:00:00Z\t%s\n", other)
+	if err = os.MkdirAll(experiment.PrintExperimentPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(experiment.PrintExperimentPath(), ANALYSIS_INDEX_FILE), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		paramFile string
+		want      string
+	}{
+		{"params.json", "20240103-090000"},
+		{"./other.json", "20240104-090000"},
+		{"new.json", ""},
+	}
+	for _, tt := range tests {
+		id, err := latestAnalysisID(experiment, tt.paramFile)
+		if err != nil || id != tt.want {
+			t.Errorf("latestAnalysisID(%s) = %q, %v, want %q", tt.paramFile, id, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package utils
+
+import (
+	"bufio"
+	"commander/datamodels"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Set from the --verify-checksums command line flag.
+var VerifyChecksums bool
+
+// Checksum algorithms understood for read files. Each can be given as a
+// sample sheet column (md5=<R1>,<R2>) or as a <algorithm>sum.txt file in the
+// sample directory.
+var CHECKSUM_ALGORITHMS = []string{"md5", "sha256"}
+
+// Hashing raw reads is IO bound, so don't start more workers than this.
+const MAX_CHECKSUM_WORKERS = 8
+
+// Checksums of files already hashed, keyed by path. An entry is only used
+// while the file keeps the size and modification time it was hashed with.
+type checksumCacheEntry struct {
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"mtime"`
+	Sums    map[string]string `json:"sums"`
+}
+
+var checksumCache map[string]checksumCacheEntry
+var checksumCacheLock sync.Mutex
+
+// A read file and the checksum it is expected to have.
+type checksumCheck struct {
+	Path      string
+	Algorithm string
+	Expected  string
+}
+
+/* -----------------------------------------------------------------------------
+ * Verify the raw read files against their published checksums.
+ * -------------------------------------------------------------------------- */
+func testSampleChecksums(experiment datamodels.Experiment) error {
+	checks, missing, err := collectChecksumChecks(experiment)
+	if err != nil {
+		return err
+	}
+	for _, path := range missing {
+		preflightWarning("No checksum given for %s. Skipping verification.", path)
+	}
+	if len(checks) == 0 {
+		fmt.Println()
+		return nil
+	}
+
+	loadChecksumCache()
+
+	var workers = runtime.NumCPU()
+	if workers > MAX_CHECKSUM_WORKERS {
+		workers = MAX_CHECKSUM_WORKERS
+	}
+
+	var queue = make(chan checksumCheck)
+	var failures = make([]string, 0)
+	var done = 0
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range queue {
+				sum, err := fileChecksum(check.Path, check.Algorithm)
+
+				lock.Lock()
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%s: %s", check.Path, err.Error()))
+				} else if !strings.EqualFold(sum, check.Expected) {
+					failures = append(failures, fmt.Sprintf("%s: %s is %s but %s was expected", check.Path, check.Algorithm, sum, check.Expected))
+				}
+				done++
+				fmt.Printf("\rVerified %d/%d read files", done, len(checks))
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, check := range checks {
+		queue <- check
+	}
+	close(queue)
+	wg.Wait()
+	fmt.Print("\n\n")
+
+	if err = saveChecksumCache(); err != nil {
+		preflightWarning("Could not save the checksum cache: %s", err.Error())
+	}
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		fmt.Print("The following read files failed checksum verification...\n\n")
+		for _, f := range failures {
+			fmt.Println(f)
+		}
+		fmt.Println()
+		return fmt.Errorf("Checksum error. %d read files do not match their checksums. They may be corrupted. Please transfer them again.", len(failures))
+	}
+	return nil
+}
+
+/* ---
+ * Pair every read file with its expected checksum. Checksums in the sample
+ * sheet win over checksum files. Files without any checksum are returned
+ * separately.
+ * --- */
+func collectChecksumChecks(experiment datamodels.Experiment) ([]checksumCheck, []string, error) {
+	var checks = make([]checksumCheck, 0)
+	var missing = make([]string, 0)
+
+	sumFiles := make(map[string]map[string]string)
+	for _, algorithm := range CHECKSUM_ALGORITHMS {
+		sums, err := parseChecksumFile(fmt.Sprintf("%s/%ssum.txt", experiment.PrintRawSamplePath(), algorithm))
+		if err != nil {
+			return checks, missing, err
+		}
+		sumFiles[algorithm] = sums
+	}
+
+	for _, sample := range experiment.Samples {
+		reads := []string{sample.ForwardReadFile}
+		if sample.ReverseReadFile != "" {
+			reads = append(reads, sample.ReverseReadFile)
+		}
+
+		for i, read := range reads {
+			path := fmt.Sprintf("%s/%s", experiment.PrintRawSamplePath(), read)
+			check, ok := sampleSheetChecksum(sample, i)
+			if !ok {
+				check, ok = checksumFileChecksum(sumFiles, read)
+			}
+			if !ok {
+				missing = append(missing, path)
+				continue
+			}
+			check.Path = path
+			checks = append(checks, check)
+		}
+	}
+	return checks, missing, nil
+}
+
+/* ---
+ * Look up the checksum of the i-th read of a sample in its sample sheet
+ * columns, e.g. md5=<R1 md5>,<R2 md5>.
+ * --- */
+func sampleSheetChecksum(sample datamodels.Sample, i int) (checksumCheck, bool) {
+	for _, algorithm := range CHECKSUM_ALGORITHMS {
+		value, ok := sample.Metadata[algorithm]
+		if !ok {
+			continue
+		}
+		sums := strings.Split(value, ",")
+		if i < len(sums) && sums[i] != "" {
+			return checksumCheck{Algorithm: algorithm, Expected: sums[i]}, true
+		}
+	}
+	return checksumCheck{}, false
+}
+
+func checksumFileChecksum(sumFiles map[string]map[string]string, read string) (checksumCheck, bool) {
+	for _, algorithm := range CHECKSUM_ALGORITHMS {
+		if sum, ok := sumFiles[algorithm][filepath.Base(read)]; ok {
+			return checksumCheck{Algorithm: algorithm, Expected: sum}, true
+		}
+	}
+	return checksumCheck{}, false
+}
+
+/* ---
+ * Parse a file in md5sum/sha256sum format into a map from file name to
+ * checksum. A missing file gives an empty map.
+ * --- */
+func parseChecksumFile(path string) (map[string]string, error) {
+	var sums = make(map[string]string)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return sums, nil
+	} else if err != nil {
+		return sums, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// Binary mode entries start the file name with a "*".
+		name := strings.TrimPrefix(fields[1], "*")
+		sums[filepath.Base(name)] = fields[0]
+	}
+	return sums, scanner.Err()
+}
+
+/* ---
+ * Return the checksum of a file, hashing it only if the cache has no entry for
+ * the file's current size and modification time.
+ * --- */
+func fileChecksum(path, algorithm string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if sum, ok := cachedChecksum(path, algorithm, info); ok {
+		return sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var h hash.Hash
+	if algorithm == "md5" {
+		h = md5.New()
+	} else {
+		h = sha256.New()
+	}
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	key := checksumCacheKey(path, info)
+	checksumCacheLock.Lock()
+	defer checksumCacheLock.Unlock()
+	entry, ok := checksumCache[key]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		entry = checksumCacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Sums: make(map[string]string)}
+	}
+	entry.Sums[algorithm] = sum
+	checksumCache[key] = entry
+	return sum, nil
+}
+
+func cachedChecksum(path, algorithm string, info os.FileInfo) (string, bool) {
+	key := checksumCacheKey(path, info)
+	checksumCacheLock.Lock()
+	defer checksumCacheLock.Unlock()
+	entry, ok := checksumCache[key]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return "", false
+	}
+	sum, ok := entry.Sums[algorithm]
+	return sum, ok
+}
+
+/* ---
+ * Return the cache key of a file. The cache is shared between projects, so
+ * files are told apart by absolute path, device and inode rather than by the
+ * path as given.
+ * --- */
+func checksumCacheKey(path string, info os.FileInfo) string {
+	key := absPath(path)
+	if dev, ino, ok := fileIdentity(info); ok {
+		key = fmt.Sprintf("%s@%d:%d", key, dev, ino)
+	}
+	return key
+}
+
+/* ---
+ * The cache lives in the user's cache directory so it is shared between
+ * analyses of the same reads.
+ * --- */
+func checksumCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "commander", "checksums.json"), nil
+}
+
+func loadChecksumCache() {
+	checksumCache = make(map[string]checksumCacheEntry)
+	path, err := checksumCachePath()
+	if err != nil {
+		return
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(content, &checksumCache); err != nil {
+		// Start over from an unreadable cache.
+		checksumCache = make(map[string]checksumCacheEntry)
+	}
+}
+
+func saveChecksumCache() error {
+	if DryRun {
+		return nil
+	}
+	path, err := checksumCachePath()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(checksumCache)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileChecksumCacheAcrossProjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "commander")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	// Two projects with reads of the same relative path, size and mtime.
+	mtime := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	for _, project := range []string{"a", "b"} {
+		reads := filepath.Join(dir, project, "reads")
+		if err = os.MkdirAll(reads, 0755); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(reads, "A_R1.fastq.gz")
+		if err = ioutil.WriteFile(path, []byte("reads of "+project), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checksumCache = make(map[string]checksumCacheEntry)
+	var sums = make(map[string]string)
+	for _, project := range []string{"a", "b"} {
+		if err = os.Chdir(filepath.Join(dir, project)); err != nil {
+			t.Fatal(err)
+		}
+		sums[project], err = fileChecksum("reads/A_R1.fastq.gz", "md5")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sums["a"] == sums["b"] {
+		t.Errorf("fileChecksum() gave the same checksum %s for reads of both projects", sums["a"])
+	}
+	if len(checksumCache) != 2 {
+		t.Errorf("checksum cache has %d entries, want 2", len(checksumCache))
+	}
+}
@@ -0,0 +1,350 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/Jeffail/gabs"
+)
+
+/* -----------------------------------------------------------------------------
+ * Functions for parsing the cluster description.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Parse a cluster description file. The file is either JSON, e.g.
+ * {
+ *   "partitions": [
+ *     {"name": "short", "max_cpus": 32, "max_memory": 128000, "max_time": "04:00:00", "nodes": ["c01", "c02"]},
+ *     {"name": "long", "max_cpus": 64, "max_memory": 512000, "max_time": "7-00:00:00", "nodes": ["c03"]}
+ *   ]
+ * }
+ * or the saved text output of "scontrol show partition" or of
+ * sinfo -o "%P %c %m %l %N".
+ * --- */
+func ParseClusterFile(filename string) (datamodels.Cluster, error) {
+	var cluster datamodels.Cluster
+
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return cluster, err
+	}
+
+	content := strings.TrimSpace(string(raw))
+	if strings.HasPrefix(content, "{") {
+		cluster, err = clusterFromJSON(raw)
+	} else if strings.Contains(content, "PartitionName=") {
+		cluster, err = clusterFromScontrol(content)
+	} else {
+		cluster, err = clusterFromSinfo(content)
+	}
+	if err != nil {
+		return cluster, fmt.Errorf("cluster error: %s: %s", filename, err.Error())
+	}
+	if len(cluster.Partitions) == 0 {
+		return cluster, fmt.Errorf("cluster error: %s describes no partitions", filename)
+	}
+	return cluster, nil
+}
+
+/* ---
+ * Parse the time limit of a partition. Partitions without a limit give zero.
+ * --- */
+func partitionTime(name, value string) (datamodels.WallTime, error) {
+	for _, unlimited := range datamodels.UNLIMITED_TIMES {
+		if strings.EqualFold(value, unlimited) {
+			return 0, nil
+		}
+	}
+	wallTime, err := datamodels.ParseWallTime(value)
+	if err != nil {
+		return 0, fmt.Errorf("partition %s: %s", name, err.Error())
+	}
+	return wallTime, nil
+}
+
+func clusterFromJSON(raw []byte) (datamodels.Cluster, error) {
+	var cluster = datamodels.Cluster{Partitions: make([]datamodels.Partition, 0)}
+
+	jsonParsed, err := gabs.ParseJSON(raw)
+	if err != nil {
+		return cluster, err
+	}
+
+	for _, c := range jsonParsed.Path("partitions").Children() {
+		var partition = datamodels.Partition{Nodes: make([]string, 0)}
+		var ok bool
+		if !c.Exists("name") {
+			return cluster, errors.New(`Missing parameter "name" in partition`)
+		}
+		if partition.Name, ok = c.Path("name").Data().(string); !ok {
+			return cluster, fmt.Errorf(`partition name %v is not a string`, c.Path("name").Data())
+		}
+		if c.Exists("default") {
+			if partition.Default, ok = c.Path("default").Data().(bool); !ok {
+				return cluster, fmt.Errorf(`partition %s: "default" must be true or false`, partition.Name)
+			}
+		}
+		if c.Exists("max_cpus") {
+			cpus, ok := c.Path("max_cpus").Data().(float64)
+			if !ok {
+				return cluster, fmt.Errorf(`partition %s: "max_cpus" is not a number`, partition.Name)
+			}
+			partition.MaxCPUs = int64(cpus)
+		}
+		if c.Exists("max_memory") {
+			partition.MaxMemory, err = memoryFromJSON(c.Path("max_memory"))
+			if err != nil {
+				return cluster, fmt.Errorf("partition %s: %s", partition.Name, err.Error())
+			}
+		}
+		if c.Exists("max_time") {
+			if maxTime, ok := c.Path("max_time").Data().(string); ok {
+				partition.MaxTime, err = partitionTime(partition.Name, maxTime)
+			} else if partition.MaxTime, err = wallTimeFromJSON(c.Path("max_time")); err != nil {
+				err = fmt.Errorf("partition %s: %s", partition.Name, err.Error())
+			}
+			if err != nil {
+				return cluster, err
+			}
+		}
+		for _, node := range c.Path("nodes").Children() {
+			name, ok := node.Data().(string)
+			if !ok {
+				return cluster, fmt.Errorf(`partition %s: node %v is not a string`, partition.Name, node.Data())
+			}
+			partition.Nodes = append(partition.Nodes, name)
+		}
+		cluster.Partitions = append(cluster.Partitions, partition)
+	}
+	return cluster, nil
+}
+
+/* ---
+ * Parse "scontrol show partition" output. Every partition is a run of
+ * Key=Value fields starting with PartitionName. CPUs per node fall back to
+ * TotalCPUs/TotalNodes when MaxCPUsPerNode is unlimited. scontrol does not
+ * show the memory of the nodes, so only MaxMemPerNode is used.
+ * --- */
+func clusterFromScontrol(content string) (datamodels.Cluster, error) {
+	var cluster = datamodels.Cluster{Partitions: make([]datamodels.Partition, 0)}
+	var fields map[string]string
+	var err error
+
+	flush := func() {
+		if fields == nil || err != nil {
+			return
+		}
+		partition := datamodels.Partition{
+			Name:      fields["PartitionName"],
+			Default:   fields["Default"] == "YES",
+			MaxCPUs:   scontrolNumber(fields["MaxCPUsPerNode"]),
+			MaxMemory: datamodels.Memory(scontrolNumber(fields["MaxMemPerNode"])),
+			Nodes:     make([]string, 0),
+		}
+		partition.MaxTime, err = partitionTime(partition.Name, fields["MaxTime"])
+		if partition.MaxCPUs == 0 {
+			totalCPUs := scontrolNumber(fields["TotalCPUs"])
+			totalNodes := scontrolNumber(fields["TotalNodes"])
+			if totalNodes > 0 {
+				partition.MaxCPUs = totalCPUs / totalNodes
+			}
+		}
+		if nodes, ok := fields["Nodes"]; ok && nodes != "" && nodes != "(null)" {
+			partition.Nodes = append(partition.Nodes, nodes)
+		}
+		cluster.Partitions = append(cluster.Partitions, partition)
+	}
+
+	for _, field := range strings.Fields(content) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if kv[0] == "PartitionName" {
+			flush()
+			fields = make(map[string]string)
+		}
+		if fields != nil {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	flush()
+	return cluster, err
+}
+
+/* ---
+ * Parse a number from scontrol output. UNLIMITED and unparseable values give
+ * zero.
+ * --- */
+func scontrolNumber(value string) int64 {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+/* ---
+ * Parse sinfo output with a header line. The PARTITION column is required and
+ * CPUS, MEMORY, TIMELIMIT and NODELIST are used when present. sinfo prints a
+ * line per group of alike nodes, so a partition keeps the largest node it
+ * has. The default partition is marked with a trailing "*".
+ * --- */
+func clusterFromSinfo(content string) (datamodels.Cluster, error) {
+	var cluster = datamodels.Cluster{Partitions: make([]datamodels.Partition, 0)}
+	var columns = make(map[string]int)
+
+	lines := strings.Split(content, "\n")
+	for i, name := range strings.Fields(lines[0]) {
+		columns[strings.ToUpper(name)] = i
+	}
+	if _, ok := columns["PARTITION"]; !ok {
+		return cluster, errors.New(`not JSON, scontrol or sinfo output. sinfo output needs a header line with a PARTITION column`)
+	}
+
+	column := func(fields []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(fields) {
+			return ""
+		}
+		return fields[i]
+	}
+
+	var index = make(map[string]int)
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := column(fields, "PARTITION")
+		isDefault := strings.HasSuffix(name, "*")
+		name = strings.TrimSuffix(name, "*")
+
+		i, ok := index[name]
+		if !ok {
+			cluster.Partitions = append(cluster.Partitions, datamodels.Partition{Name: name, Nodes: make([]string, 0)})
+			i = len(cluster.Partitions) - 1
+			index[name] = i
+		}
+		p := &cluster.Partitions[i]
+		p.Default = p.Default || isDefault
+
+		maxTime, err := partitionTime(name, column(fields, "TIMELIMIT"))
+		if err != nil {
+			return cluster, err
+		}
+		if maxTime > p.MaxTime {
+			p.MaxTime = maxTime
+		}
+
+		// Node groups of different sizes are shown as e.g. "32+".
+		cpus, _ := strconv.ParseInt(strings.TrimSuffix(column(fields, "CPUS"), "+"), 10, 64)
+		if cpus > p.MaxCPUs {
+			p.MaxCPUs = cpus
+		}
+		memory, _ := strconv.ParseInt(strings.TrimSuffix(column(fields, "MEMORY"), "+"), 10, 64)
+		if datamodels.Memory(memory) > p.MaxMemory {
+			p.MaxMemory = datamodels.Memory(memory)
+		}
+		if nodes := column(fields, "NODELIST"); nodes != "" {
+			p.Nodes = append(p.Nodes, nodes)
+		}
+	}
+	return cluster, nil
+}
+
+/* -----------------------------------------------------------------------------
+ * Check the resources of the job against the cluster.
+ * -------------------------------------------------------------------------- */
+func testClusterLimits(job datamodels.Job) error {
+	cluster, err := ParseClusterFile(job.ClusterFile)
+	if err != nil {
+		return err
+	}
+
+	preamble := job.SlurmPreamble
+	partition, ok := cluster.Partition(preamble.Partition)
+	if !ok {
+		return fmt.Errorf("cluster error: partition %s does not exist. The cluster has partitions %s", preamble.Partition, strings.Join(cluster.PartitionNames(), ", "))
+	}
+	fmt.Printf(
+		"Partition %s: %s CPUs and %s memory per node, time limit %s, nodes %s\n\n",
+		partition.Name,
+		clusterLimit(partition.MaxCPUs, fmt.Sprintf("%d", partition.MaxCPUs)),
+		clusterLimit(int64(partition.MaxMemory), partition.MaxMemory.String()),
+		clusterLimit(int64(partition.MaxTime), partition.MaxTime.String()),
+		strings.Join(partition.Nodes, ","),
+	)
+
+	// In a single job every step runs in the job's partition and time. As
+	// separate jobs, steps may pick their own, as does a single non-batch
+	// command, which is the job. Memory is requested per CPU, except for a
+	// single non-batch command.
+	var problems = make([]string, 0)
+	var separate = job.Details.IsSeparateSubmission() || job.IsStandaloneCommand()
+	if !separate {
+		problems = append(problems, partition.Exceeds(0, 0, preamble.WallTime)...)
+	}
+	fmt.Printf("%-20s %-12s %6s %10s %12s\n", "step", "partition", "cpus", "memory", "time")
+	for _, cmd := range job.Commands {
+		stepPreamble := cmd.Preamble.WithDefaults(preamble)
+		if !separate {
+			stepPreamble.Partition = preamble.Partition
+		}
+		cpus := stepPreamble.CPUs * stepPreamble.Tasks
+		memory := stepPreamble.Memory.Times(cpus)
+		if job.IsStandaloneCommand() {
+			memory = stepPreamble.Memory
+		}
+		fmt.Printf("%-20s %-12s %6d %10s %12s\n", cmd.StepID(), stepPreamble.Partition, cpus, memory, stepPreamble.WallTime)
+
+		if !separate && stepPreamble.WallTime > preamble.WallTime {
+			preflightWarning("step %s asks for %s, longer than the job's wall time of %s", cmd.StepID(), stepPreamble.WallTime, preamble.WallTime)
+		}
+
+		stepPartition, ok := cluster.Partition(stepPreamble.Partition)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("step %s: partition %s does not exist", cmd.StepID(), stepPreamble.Partition))
+			continue
+		}
+		exceeded := stepPartition.Exceeds(cpus, memory, 0)
+		if separate {
+			exceeded = stepPartition.Exceeds(cpus, memory, stepPreamble.WallTime)
+		}
+		for _, p := range exceeded {
+			problems = append(problems, fmt.Sprintf("step %s: %s", cmd.StepID(), p))
+		}
+		if len(exceeded) > 0 {
+			if fit, ok := cluster.SmallestFit(cpus, memory, stepPreamble.WallTime); ok {
+				problems = append(problems, fmt.Sprintf("step %s: the smallest partition that fits is %s", cmd.StepID(), fit.Name))
+			} else {
+				problems = append(problems, fmt.Sprintf("step %s: no partition fits", cmd.StepID()))
+			}
+		}
+	}
+	fmt.Println()
+
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Println()
+	return errors.New("cluster error: the job does not fit the cluster. See the problems listed above")
+}
+
+/* ---
+ * Describe a partition limit, which is unlimited when zero.
+ * --- */
+func clusterLimit(value int64, description string) string {
+	if value == 0 {
+		return "unlimited"
+	}
+	return description
+}
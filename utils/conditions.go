@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+)
+
+// Samples of batch steps whose when clause excluded them, keyed like the
+// resume plan. The value is the reason the sample was excluded.
+var excludedSteps = make(map[resumeKey]string)
+
+/* -----------------------------------------------------------------------------
+ * Evaluate the when clause of every batch step against every sample.
+ * -------------------------------------------------------------------------- */
+func PlanConditions(job datamodels.Job) error {
+	excludedSteps = make(map[resumeKey]string)
+
+	dag, err := job.BuildDAG()
+	if err != nil {
+		return err
+	}
+
+	levels, err := dag.Levels()
+	if err != nil {
+		return err
+	}
+
+	// Walk the schedule in order so a sample excluded from a step is also
+	// excluded from every batch step downstream of it.
+	for _, level := range levels {
+		for _, id := range level {
+			cmd := job.Commands[dag.Index[id]]
+			if !cmd.Batch {
+				continue
+			}
+			for _, sample := range job.ExperimentDetails.Samples {
+				if ok, reason := cmd.When.Matches(sample); !ok {
+					excludedSteps[resumeKey{id, sample.Prefix}] = fmt.Sprintf("condition not met (%s)", reason)
+					continue
+				}
+				for _, parentID := range dag.Parents[id] {
+					if _, ok := excludedSteps[resumeKey{parentID, sample.Prefix}]; ok {
+						excludedSteps[resumeKey{id, sample.Prefix}] = fmt.Sprintf("upstream step %s was excluded", parentID)
+						break
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
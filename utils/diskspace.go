@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Warn once the projected output takes more than this share of the free
+// space or inodes.
+const DISK_WARN_FRACTION = 0.9
+
+/* -----------------------------------------------------------------------------
+ * Estimate the space the analysis needs and compare it with what is free.
+ * -------------------------------------------------------------------------- */
+func testDiskSpace(job datamodels.Job) error {
+	experiment := job.ExperimentDetails
+
+	// Size of the raw reads of every sample.
+	var readBytes = make(map[string]int64)
+	var totalReadBytes int64
+	for _, sample := range experiment.Samples {
+		reads := []string{sample.DumpForwardReadFileWithPath()}
+		if sample.IsPairedEnd() {
+			reads = append(reads, sample.DumpReverseReadFileWithPath())
+		}
+		for _, read := range reads {
+			if info, err := os.Stat(read); err == nil {
+				readBytes[sample.Prefix] += info.Size()
+				totalReadBytes += info.Size()
+			}
+		}
+	}
+
+	// Steps may write to different filesystems, so sum the output on each.
+	// The filesystems of the analysis and work directories are checked even
+	// when no step output lands on them.
+	var filesystems = make([]*filesystemUsage, 0)
+	var byID = make(map[string]*filesystemUsage)
+	addFilesystem := func(path string) *filesystemUsage {
+		id := filesystemOf(path)
+		if _, ok := byID[id]; !ok {
+			byID[id] = &filesystemUsage{Path: path}
+			filesystems = append(filesystems, byID[id])
+		}
+		return byID[id]
+	}
+	addFilesystem(experiment.PrintAnalysisPath())
+	if experiment.WorkDir != "" {
+		addFilesystem(experiment.PrintWorkingDirectory())
+	}
+
+	var totalBytes, totalFiles uint64
+	fmt.Printf("%-24s %10s %12s %10s\n", "step", "samples", "est. size", "est. files")
+	for _, cmd := range job.Commands {
+		multiplier, filesPerSample := datamodels.OutputEstimate(cmd)
+
+		var samples = 0
+		var inputBytes int64
+		if cmd.Batch {
+			for _, sample := range experiment.Samples {
+				if stepPlanned(cmd, &sample) {
+					samples++
+					inputBytes += readBytes[sample.Prefix]
+				}
+			}
+		} else if stepPlanned(cmd, nil) {
+			samples = 1
+			inputBytes = totalReadBytes
+		}
+
+		stepBytes := uint64(float64(inputBytes) * multiplier)
+		stepFiles := uint64(samples * filesPerSample)
+		totalBytes += stepBytes
+		totalFiles += stepFiles
+		fmt.Printf("%-24s %10d %12s %10d\n", cmd.StepID(), samples, formatBytes(stepBytes), stepFiles)
+
+		outputPath := cmd.HostOutputPath
+		if outputPath == "" {
+			outputPath = experiment.PrintAnalysisPath()
+		}
+		fs := addFilesystem(outputPath)
+		fs.Bytes += stepBytes
+		fs.Files += stepFiles
+	}
+	fmt.Printf("%-24s %10s %12s %10d\n\n", "total", "", formatBytes(totalBytes), totalFiles)
+
+	for _, fs := range filesystems {
+		freeBytes, freeInodes, ok := filesystemFree(existingParent(fs.Path))
+		if !ok {
+			preflightWarning("Could not read the free space on the filesystem holding %s. Skipping the disk space check.", fs.Path)
+			continue
+		}
+		fmt.Printf("Filesystem holding %s has %s and %d inodes free and gets about %s in %d files.\n", fs.Path, formatBytes(freeBytes), freeInodes, formatBytes(fs.Bytes), fs.Files)
+
+		if freeBytes == 0 || freeInodes == 0 {
+			return fmt.Errorf("Disk space error. The filesystem holding %s has no free space or inodes left.", fs.Path)
+		}
+		if fs.Bytes > freeBytes {
+			return fmt.Errorf("Disk space error. The analysis writes about %s but only %s is free on the filesystem holding %s.", formatBytes(fs.Bytes), formatBytes(freeBytes), fs.Path)
+		}
+		if fs.Files > freeInodes {
+			return fmt.Errorf("Disk space error. The analysis writes about %d files but only %d inodes are free on the filesystem holding %s.", fs.Files, freeInodes, fs.Path)
+		}
+		if float64(fs.Bytes) > DISK_WARN_FRACTION*float64(freeBytes) || float64(fs.Files) > DISK_WARN_FRACTION*float64(freeInodes) {
+			preflightWarning("The analysis will nearly fill the filesystem holding %s.", fs.Path)
+		}
+	}
+	fmt.Println()
+	return nil
+}
+
+// The projected output written to one filesystem.
+type filesystemUsage struct {
+	Path  string
+	Bytes uint64
+	Files uint64
+}
+
+/* ---
+ * Return an ID for the filesystem holding a path. Where the filesystem can't
+ * be told, the closest existing directory stands in for it.
+ * --- */
+func filesystemOf(path string) string {
+	parent := existingParent(path)
+	if device, ok := filesystemDevice(parent); ok {
+		return fmt.Sprintf("dev:%d", device)
+	}
+	return parent
+}
+
+/* ---
+ * Check if a step (or a sample of a batch step) will be written to the job
+ * script, without recording anything in the generation summary.
+ * --- */
+func stepPlanned(cmd datamodels.Command, sample *datamodels.Sample) bool {
+	var key = resumeKey{cmd.StepID(), ""}
+	if sample != nil {
+		key.Sample = sample.Prefix
+	}
+	if _, ok := excludedSteps[key]; ok {
+		return false
+	}
+	return !completedSteps[key]
+}
+
+/* ---
+ * Return the closest existing directory at or above a path. Analysis
+ * directories may not exist before preflight creates them.
+ * --- */
+func existingParent(path string) string {
+	path, _ = filepath.Abs(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"bufio"
+	"commander/datamodels"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Set from the --fastq-check command line flag.
+var FastqCheck = FASTQ_CHECK_OFF
+
+// How thoroughly preflight reads the FASTQ files. Quick only reads the head of
+// every file. Full streams every file to the end.
+const (
+	FASTQ_CHECK_OFF   = "off"
+	FASTQ_CHECK_QUICK = "quick"
+	FASTQ_CHECK_FULL  = "full"
+)
+
+// Number of records read from the head of each file in quick mode. Read names
+// of paired files are compared over the same number of records.
+const FASTQ_HEAD_RECORDS = 10000
+
+// Quality encodings told apart by the lowest quality character seen.
+const (
+	QUALITY_PHRED33 = "phred+33"
+	QUALITY_PHRED64 = "phred+64"
+	QUALITY_UNKNOWN = "unknown"
+)
+
+// What was learned from reading a FASTQ file.
+type fastqStats struct {
+	Path     string
+	Records  int64
+	Complete bool
+	Encoding string
+	Names    []string
+	Problems []string
+}
+
+/* -----------------------------------------------------------------------------
+ * Check the content of the raw read files.
+ * -------------------------------------------------------------------------- */
+func IsFastqCheckLevel(level string) bool {
+	switch level {
+	case FASTQ_CHECK_OFF, FASTQ_CHECK_QUICK, FASTQ_CHECK_FULL:
+		return true
+	}
+	return false
+}
+
+/* ---
+ * Read the FASTQ files of every sample and report per-sample problems. Samples
+ * are checked in parallel.
+ * --- */
+func testSampleFastqs(experiment datamodels.Experiment) error {
+	var problems = make(map[string][]string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var queue = make(chan datamodels.Sample)
+
+	var workers = runtime.NumCPU()
+	if workers > MAX_CHECKSUM_WORKERS {
+		workers = MAX_CHECKSUM_WORKERS
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sample := range queue {
+				sampleProblems := checkSampleFastqs(sample)
+				if len(sampleProblems) > 0 {
+					lock.Lock()
+					problems[sample.Prefix] = sampleProblems
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, sample := range experiment.Samples {
+		queue <- sample
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(problems) == 0 {
+		fmt.Printf("All %d samples passed the %s FASTQ check.\n\n", len(experiment.Samples), FastqCheck)
+		return nil
+	}
+
+	var prefixes = make([]string, 0)
+	for prefix := range problems {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	fmt.Print("The following samples have problems with their read files...\n\n")
+	for _, prefix := range prefixes {
+		fmt.Printf("%s:\n", prefix)
+		for _, p := range problems[prefix] {
+			fmt.Printf("  - %s\n", p)
+		}
+	}
+	fmt.Println()
+	return fmt.Errorf("FASTQ error. %d of %d samples have problems with their read files.", len(problems), len(experiment.Samples))
+}
+
+/* ---
+ * Check the read files of a single sample, and that paired files agree.
+ * --- */
+func checkSampleFastqs(sample datamodels.Sample) []string {
+	var problems = make([]string, 0)
+
+	forward := readFastq(sample.DumpForwardReadFileWithPath())
+	problems = append(problems, forward.Problems...)
+	if !sample.IsPairedEnd() {
+		return problems
+	}
+
+	reverse := readFastq(sample.DumpReverseReadFileWithPath())
+	problems = append(problems, reverse.Problems...)
+	if len(forward.Problems) > 0 || len(reverse.Problems) > 0 {
+		// Comparing broken files only adds noise.
+		return problems
+	}
+
+	if forward.Complete && reverse.Complete && forward.Records != reverse.Records {
+		problems = append(problems, fmt.Sprintf("R1 has %d reads but R2 has %d", forward.Records, reverse.Records))
+	} else if forward.Complete != reverse.Complete {
+		problems = append(problems, fmt.Sprintf("R1 and R2 have different read counts (%d and %d read so far)", forward.Records, reverse.Records))
+	}
+
+	if forward.Encoding != reverse.Encoding && forward.Encoding != QUALITY_UNKNOWN && reverse.Encoding != QUALITY_UNKNOWN {
+		problems = append(problems, fmt.Sprintf("R1 quality is %s but R2 quality is %s", forward.Encoding, reverse.Encoding))
+	}
+
+	for i := 0; i < len(forward.Names) && i < len(reverse.Names); i++ {
+		if forward.Names[i] != reverse.Names[i] {
+			problems = append(problems, fmt.Sprintf("read %d is %s in R1 but %s in R2", i+1, forward.Names[i], reverse.Names[i]))
+			break
+		}
+	}
+	return problems
+}
+
+/* ---
+ * Stream a FASTQ file, gzipped or not, checking the structure of every record
+ * read. Quick mode stops after FASTQ_HEAD_RECORDS records.
+ * --- */
+func readFastq(path string) fastqStats {
+	var stats = fastqStats{Path: path, Encoding: QUALITY_UNKNOWN, Names: make([]string, 0)}
+	var minQuality = byte(255)
+
+	problem := func(format string, a ...interface{}) fastqStats {
+		stats.Problems = append(stats.Problems, fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, a...)))
+		return stats
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return problem("%s", err.Error())
+	}
+	defer f.Close()
+
+	var reader io.Reader
+	buffered := bufio.NewReader(f)
+	magic, err := buffered.Peek(2)
+	if err == io.EOF || (err == nil && len(magic) == 0) {
+		return problem("file is empty")
+	} else if err != nil && err != io.EOF {
+		return problem("%s", err.Error())
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return problem("not a valid gzip file: %s", err.Error())
+		}
+		defer gz.Close()
+		reader = gz
+	} else if strings.HasSuffix(path, ".gz") {
+		return problem("file name ends in .gz but the file is not gzip compressed")
+	} else {
+		reader = buffered
+	}
+
+	scanner := bufio.NewScanner(reader)
+	// Long reads need more than the default 64k line buffer.
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	var record [4]string
+	var line = 0
+	for scanner.Scan() {
+		record[line%4] = scanner.Text()
+		line++
+		if line%4 != 0 {
+			continue
+		}
+
+		stats.Records++
+		if !strings.HasPrefix(record[0], "@") {
+			return problem("record %d header does not start with @", stats.Records)
+		}
+		if !strings.HasPrefix(record[2], "+") {
+			return problem("record %d separator line does not start with +", stats.Records)
+		}
+		if len(record[1]) != len(record[3]) {
+			return problem("record %d has %d bases but %d quality scores", stats.Records, len(record[1]), len(record[3]))
+		}
+		for i := 0; i < len(record[3]); i++ {
+			if record[3][i] < minQuality {
+				minQuality = record[3][i]
+			}
+		}
+		if len(stats.Names) < FASTQ_HEAD_RECORDS {
+			stats.Names = append(stats.Names, readName(record[0]))
+		}
+		if FastqCheck == FASTQ_CHECK_QUICK && stats.Records >= FASTQ_HEAD_RECORDS {
+			stats.Encoding = qualityEncoding(minQuality)
+			return stats
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return problem("file is truncated after %d reads", stats.Records)
+		}
+		return problem("%s", err.Error())
+	}
+	if line%4 != 0 {
+		return problem("file is truncated in the middle of record %d", stats.Records+1)
+	}
+	if stats.Records == 0 {
+		return problem("file has no reads")
+	}
+
+	stats.Complete = true
+	stats.Encoding = qualityEncoding(minQuality)
+	return stats
+}
+
+/* ---
+ * Return the name of a read without the mate suffix, so the names of paired
+ * reads compare equal.
+ * --- */
+func readName(header string) string {
+	name := strings.Fields(strings.TrimPrefix(header, "@"))
+	if len(name) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(name[0], "/1"), "/2")
+}
+
+/* ---
+ * Guess the quality encoding from the lowest quality character. Phred+33
+ * files use characters below ';'. Phred+64 files never go below '@'.
+ * --- */
+func qualityEncoding(minQuality byte) string {
+	if minQuality < ';' {
+		return QUALITY_PHRED33
+	}
+	if minQuality >= '@' && minQuality != 255 {
+		return QUALITY_PHRED64
+	}
+	return QUALITY_UNKNOWN
+}
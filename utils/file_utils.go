@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"bytes"
+	"commander/datamodels"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Set from the --dry-run command line flag. When set, nothing is written to
+// the filesystem. Planned changes are printed instead.
+var DryRun bool
+
+// Set from the --outdir command line flag. Every generated script is written
+// here. Defaults to <analysis_path>/scripts.
+var OutDir string
+
+// Every file commander wrote (or would write) during this run, with its hash.
+var writtenFiles = make([]datamodels.FileRecord, 0)
+
+/* -----------------------------------------------------------------------------
+ * Filesystem operations that respect dry-run mode.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Settle the directory generated scripts are written to. The path is made
+ * absolute so the job script can call the step scripts from wherever the job
+ * is submitted.
+ * --- */
+func ResolveOutDir(experiment datamodels.Experiment) error {
+	if OutDir == "" {
+		OutDir = fmt.Sprintf("%s/scripts", experiment.PrintAnalysisPath())
+	}
+	path, err := filepath.Abs(OutDir)
+	if err != nil {
+		return err
+	}
+	OutDir = path
+	return nil
+}
+
+/* ---
+ * A file being written by commander. In dry-run mode the content is buffered
+ * and reported when the file is closed.
+ * --- */
+type outputFile struct {
+	name string
+	file *os.File
+	buf  bytes.Buffer
+	hash hash.Hash
+	size int64
+}
+
+func (f *outputFile) Write(p []byte) (int, error) {
+	f.hash.Write(p)
+	f.size += int64(len(p))
+	if f.file == nil {
+		return f.buf.Write(p)
+	}
+	return f.file.Write(p)
+}
+
+func (f *outputFile) Close() error {
+	writtenFiles = append(writtenFiles, datamodels.FileRecord{
+		Path:   f.name,
+		Size:   f.size,
+		SHA256: hex.EncodeToString(f.hash.Sum(nil)),
+	})
+	if f.file == nil {
+		reportPlannedFile(f.name, f.buf.String())
+		return nil
+	}
+	return f.file.Close()
+}
+
+/* ---
+ * Create (or truncate) a file for writing.
+ * --- */
+func createFile(name string) (*outputFile, error) {
+	if DryRun {
+		return &outputFile{name: name, hash: sha256.New()}, nil
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &outputFile{name: name, file: file, hash: sha256.New()}, nil
+}
+
+/* ---
+ * Write a whole file at once.
+ * --- */
+func writeFile(name string, content []byte) error {
+	outfile, err := createFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err = outfile.Write(content); err != nil {
+		outfile.Close()
+		return err
+	}
+	return outfile.Close()
+}
+
+/* ---
+ * Create a directory and any missing parents.
+ * --- */
+func makeDir(path string) error {
+	if DryRun {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			fmt.Printf("[dry-run] Would create directory %s\n", path)
+		}
+		return nil
+	}
+	return os.MkdirAll(path, 0755)
+}
+
+/* ---
+ * Make a script executable.
+ * --- */
+func makeExecutable(path string) error {
+	if DryRun {
+		return nil
+	}
+	return os.Chmod(path, 0755)
+}
+
+/* ---
+ * Print the file a dry run would write. New files are printed in full. Files
+ * that exist are shown as a diff against their current content.
+ * --- */
+func reportPlannedFile(name, content string) {
+	existing, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Printf("[dry-run] Would write %s:\n", name)
+		fmt.Println(strings.TrimRight(content, "\n"))
+		fmt.Println()
+		return
+	}
+
+	if string(existing) == content {
+		fmt.Printf("[dry-run] %s is unchanged.\n\n", name)
+		return
+	}
+
+	fmt.Printf("[dry-run] Would overwrite %s:\n", name)
+	fmt.Printf("--- %s\n+++ %s\n", name, name)
+	for _, line := range lineDiff(splitLines(string(existing)), splitLines(content)) {
+		fmt.Println(line)
+	}
+	fmt.Println()
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
+
+/* ---
+ * Return a line diff between two files. Removed lines start with "-", added
+ * lines with "+" and shared lines with a space. Scripts are small, so the
+ * quadratic longest common subsequence is fine here.
+ * --- */
+func lineDiff(a, b []string) []string {
+	var diff = make([]string, 0)
+
+	// lcs[i][j] is the length of the common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			diff = append(diff, " "+a[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			diff = append(diff, "-"+a[i])
+			i++
+		} else {
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+"+b[j])
+	}
+	return diff
+}
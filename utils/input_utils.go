@@ -36,10 +36,16 @@ func ParseSamplesFile(filename string) []datamodels.Sample {
 	// Read the file line by line.
 	for scanner.Scan() {
 		line := scanner.Text()
-		chunks := strings.Split(line, "=")
+		chunks := strings.SplitN(line, "=", 2)
 		if chunks[0] == "SAMPLE" {
-			// We are assuming the files are separated with a space.
-			fileNames := strings.Split(chunks[1], " ")
+			// We are assuming the files and any key=value metadata are separated
+			// with a space.
+			fileNames, metadata := splitSampleFields(chunks[1])
+			if len(fileNames) == 0 {
+				log.Fatal(fmt.Sprintf("Samples file error: no read files listed on line \"%s\"", line))
+			}
+			sample.Metadata = metadata
+
 			// Get the file prefix from the forward read
 			sample.Prefix = ParseSamplePrefix(fileNames[0])
 
@@ -58,6 +64,24 @@ func ParseSamplesFile(filename string) []datamodels.Sample {
 	return samples
 }
 
+/* ---
+ * Split the fields of a sample line into read files and key=value metadata.
+ * --- */
+func splitSampleFields(fields string) ([]string, map[string]string) {
+	var fileNames = make([]string, 0)
+	var metadata = make(map[string]string)
+
+	for _, field := range strings.Fields(fields) {
+		if strings.Contains(field, "=") {
+			kv := strings.SplitN(field, "=", 2)
+			metadata[kv[0]] = kv[1]
+		} else {
+			fileNames = append(fileNames, field)
+		}
+	}
+	return fileNames, metadata
+}
+
 /* ---
  * Parse the sample prefix from a read file.
  * --- */
@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/Jeffail/gabs"
 )
@@ -73,6 +75,12 @@ func ParseJSONParams(filename string) (datamodels.Job, error) {
 	}
 	job.MiscPreamble = miscPreamble
 
+	// Extract the default container settings for the commands.
+	job.Container, err = containerFromJSON(jsonParsed, datamodels.ContainerParams{})
+	if err != nil {
+		return job, err
+	}
+
 	// Extract the commands from the params file.
 	var cmdErr error
 	var commands = make([]datamodels.Command, 0)
@@ -86,8 +94,18 @@ func ParseJSONParams(filename string) (datamodels.Job, error) {
 			return job, cmdErr
 		}
 
-		// Set input_from argument.
-		command.InputFromStep = inputFromStep(c)
+		// Set the step id and the steps this command takes input from.
+		command.ID, cmdErr = stepIDFromJSON(c)
+		if cmdErr != nil {
+			return job, cmdErr
+		}
+		command.Inputs = inputsFromJSON(c)
+		command.Outputs = outputsFromJSON(c)
+
+		// Set the reference genome the command uses, if any.
+		if c.Exists("reference") && c.Path("reference").Data() != nil {
+			command.ReferenceName = c.Path("reference").Data().(string)
+		}
 
 		// Extract and set command preamble.
 		preamble, cmdErr := commandPreambleFromJSON(c)
@@ -97,21 +115,63 @@ func ParseJSONParams(filename string) (datamodels.Job, error) {
 		command.Preamble = preamble
 
 		// Extract and set the command params.
-		params, cmdErr := commandParamsFromJSON(c)
+		params, cmdErr := commandParamsFromJSON(c, job.Container)
 		if cmdErr != nil {
 			return job, cmdErr
 		}
 		command.CommandParams = params
+
+		// Set the per-sample conditions for the command.
+		command.When, cmdErr = whenFromJSON(c)
+		if cmdErr != nil {
+			return job, cmdErr
+		}
+		if !command.When.IsEmpty() && !command.Batch {
+			return job, fmt.Errorf(`JSON error: "when" is only supported on batch commands (command "%s")`, command.CommandName())
+		}
 		commands = append(commands, command)
 	}
 	job.Commands = commands
 
-	// Extract any cleanup actions for the job.
-	cleanup, err := cleanupFromJSON(jsonParsed)
+	// Give every step a unique name.
+	job.AssignStepNames()
+
+	// A single job runs in one allocation, so steps can't pick its partition,
+	// account or QOS. A single non-batch command is the job, so its settings
+	// are written to the job preamble.
+	if !job.Details.IsSeparateSubmission() && !job.IsStandaloneCommand() {
+		for _, cmd := range job.Commands {
+			if cmd.Preamble.Partition != "" || cmd.Preamble.Account != "" || cmd.Preamble.QOS != "" {
+				fmt.Printf("WARNING: step %s sets a partition, account or qos, which are ignored since the steps share one job. Use submission_mode \"separate\" to submit every step as its own job.\n\n", cmd.StepID())
+			}
+		}
+	}
+
+	// Look up the reference index of every command that names a reference.
+	var registryFile string
+	if jsonParsed.Exists("reference_registry") && jsonParsed.Path("reference_registry").Data() != nil {
+		registryFile = jsonParsed.Path("reference_registry").Data().(string)
+	}
+	err = resolveReferences(&job, registryFile)
+	if err != nil {
+		return job, err
+	}
+
+	// Set the description of the cluster the job is checked against, if any.
+	if jsonParsed.Exists("cluster_file") && jsonParsed.Path("cluster_file").Data() != nil {
+		job.ClusterFile = jsonParsed.Path("cluster_file").Data().(string)
+	}
+
+	// Extract any cleanup actions for the job and find the step directories
+	// they act on.
+	job.CleanUp, job.CleanupActions, err = cleanupFromJSON(jsonParsed)
+	if err != nil {
+		return job, err
+	}
+	err = job.ResolveCleanupSteps()
 	if err != nil {
 		return job, err
 	}
-	job.CleanUp = cleanup
 	return job, nil
 }
 
@@ -185,7 +245,9 @@ func ParsePlainTextParams(filename string) (datamodels.Job, error) {
 
 		// Set command preamble
 		if IsSlurmCommandPreamble(tag) {
-			setCommandPreamble(tag, val, &commandPreamble)
+			if err = setCommandPreamble(tag, val, &commandPreamble); err != nil {
+				return job, err
+			}
 		}
 
 		// Get and set the parameters.
@@ -207,6 +269,7 @@ func ParsePlainTextParams(filename string) (datamodels.Job, error) {
 
 	// Assign the commands to the job.
 	job.Commands = commands
+	job.AssignStepNames()
 	fmt.Printf("Done.\n")
 	return job, nil
 }
@@ -237,11 +300,87 @@ func commandNameFromJSON(jsonParsed *gabs.Container) (string, error) {
 	return "", err
 }
 
-func inputFromStep(jsonParsed *gabs.Container) string {
-	if jsonParsed.Exists("input_from_step") && jsonParsed.Path("input_from_step").Data() != nil {
-		return jsonParsed.Path("input_from_step").Data().(string)
+func stepIDFromJSON(jsonParsed *gabs.Container) (string, error) {
+	if !jsonParsed.Exists("id") || jsonParsed.Path("id").Data() == nil {
+		return "", nil
+	}
+	id, ok := jsonParsed.Path("id").Data().(string)
+	if !ok {
+		return "", fmt.Errorf(`JSON error: step id "%v" is not a string`, jsonParsed.Path("id").Data())
+	}
+	if id == "" {
+		return "", nil
+	}
+	if err := datamodels.ValidateStepID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+/* ---
+ * Collect the steps a command takes input from. Both "input_from_step" and
+ * "inputs" are accepted, either as a single string or as a list.
+ * --- */
+func inputsFromJSON(jsonParsed *gabs.Container) []string {
+	var inputs = make([]string, 0)
+	for _, key := range []string{"input_from_step", "inputs"} {
+		if !jsonParsed.Exists(key) || jsonParsed.Path(key).Data() == nil {
+			continue
+		}
+		if input, ok := jsonParsed.Path(key).Data().(string); ok {
+			if input != "" {
+				inputs = append(inputs, input)
+			}
+			continue
+		}
+		for _, c := range jsonParsed.Path(key).Children() {
+			inputs = append(inputs, c.Data().(string))
+		}
+	}
+	return inputs
+}
+
+func outputsFromJSON(jsonParsed *gabs.Container) map[string]string {
+	var outputs = make(map[string]string)
+	if jsonParsed.Exists("outputs") {
+		for name, c := range jsonParsed.Path("outputs").ChildrenMap() {
+			outputs[name] = c.Data().(string)
+		}
+	}
+	return outputs
+}
+
+/* ---
+ * Parse the optional per-sample conditions of a command, e.g.
+ * "when": {"paired_end": true, "prefix": "^ctrl", "metadata": {"qc": "yes"}}
+ * --- */
+func whenFromJSON(jsonParsed *gabs.Container) (datamodels.WhenClause, error) {
+	var when = datamodels.WhenClause{Metadata: make(map[string]string)}
+
+	if !jsonParsed.Exists("when") || jsonParsed.Path("when").Data() == nil {
+		return when, nil
+	}
+	whenJSON := jsonParsed.Path("when")
+
+	if whenJSON.Exists("paired_end") {
+		pairedEnd, ok := whenJSON.Path("paired_end").Data().(bool)
+		if !ok {
+			return when, errors.New(`JSON error: "when.paired_end" must be true or false`)
+		}
+		when.PairedEnd = &pairedEnd
+	}
+	if whenJSON.Exists("prefix") {
+		when.Prefix = whenJSON.Path("prefix").Data().(string)
+		if _, err := regexp.Compile(when.Prefix); err != nil {
+			return when, fmt.Errorf(`JSON error: invalid "when.prefix" pattern: %s`, err.Error())
+		}
+	}
+	if whenJSON.Exists("metadata") {
+		for key, c := range whenJSON.Path("metadata").ChildrenMap() {
+			when.Metadata[key] = fmt.Sprint(c.Data())
+		}
 	}
-	return ""
+	return when, nil
 }
 
 func jobDetailsFromJSON(jsonParsed *gabs.Container) (datamodels.JobDetails, error) {
@@ -259,6 +398,22 @@ func jobDetailsFromJSON(jsonParsed *gabs.Container) (datamodels.JobDetails, erro
 		if detailsJSON.Exists("design_file") {
 			details.DesignFile = detailsJSON.Path("design_file").Data().(string)
 		}
+		details.PipelineMode = datamodels.PIPELINE_MODE_BATCH
+		if detailsJSON.Exists("pipeline_mode") && detailsJSON.Path("pipeline_mode").Data() != nil {
+			details.PipelineMode = detailsJSON.Path("pipeline_mode").Data().(string)
+			if details.PipelineMode != datamodels.PIPELINE_MODE_BATCH && details.PipelineMode != datamodels.PIPELINE_MODE_PER_SAMPLE {
+				err = fmt.Errorf(`JSON error: unsupported pipeline_mode "%s". Commander currently supports batch and per_sample`, details.PipelineMode)
+				return details, err
+			}
+		}
+		details.SubmissionMode = datamodels.SUBMISSION_MODE_SINGLE
+		if detailsJSON.Exists("submission_mode") && detailsJSON.Path("submission_mode").Data() != nil {
+			details.SubmissionMode = detailsJSON.Path("submission_mode").Data().(string)
+			if details.SubmissionMode != datamodels.SUBMISSION_MODE_SINGLE && details.SubmissionMode != datamodels.SUBMISSION_MODE_SEPARATE {
+				err = fmt.Errorf(`JSON error: unsupported submission_mode "%s". Commander currently supports single and separate`, details.SubmissionMode)
+				return details, err
+			}
+		}
 	}
 	return details, nil
 }
@@ -268,7 +423,10 @@ func slurmPreambleFromJSON(jsonParsed *gabs.Container) (datamodels.SlurmPreamble
 	var preamble = datamodels.SlurmPreamble{}
 
 	if jsonParsed.Exists("wall_time") {
-		preamble.WallTime = jsonParsed.Path("wall_time").Data().(string)
+		preamble.WallTime, err = wallTimeFromJSON(jsonParsed.Path("wall_time"))
+		if err != nil {
+			return preamble, err
+		}
 	} else {
 		err = errors.New(`JSON error: Missing parameter "wall_time"`)
 		return preamble, err
@@ -303,6 +461,18 @@ func slurmPreambleFromJSON(jsonParsed *gabs.Container) (datamodels.SlurmPreamble
 		err = errors.New(`JSON error: Missing parameter "email_address"`)
 		return preamble, err
 	}
+	if jsonParsed.Exists("account") {
+		preamble.Account = jsonParsed.Path("account").Data().(string)
+	}
+	if jsonParsed.Exists("qos") {
+		preamble.QOS = jsonParsed.Path("qos").Data().(string)
+	}
+	if jsonParsed.Exists("constraint") {
+		preamble.Constraint = jsonParsed.Path("constraint").Data().(string)
+	}
+	if jsonParsed.Exists("exclusive") {
+		preamble.Exclusive = jsonParsed.Path("exclusive").Data().(bool)
+	}
 	return preamble, nil
 }
 
@@ -339,11 +509,20 @@ func sgePreambleFromJSON(jsonParsed *gabs.Container) (datamodels.SGEPreamble, er
 		return preamble, err
 	}
 	if jsonParsed.Exists("memory") {
-		preamble.Memory = jsonParsed.Path("memory").Data().(string)
+		err = sgeMemoryFromJSON(jsonParsed.Path("memory"), &preamble)
+		if err != nil {
+			return preamble, err
+		}
 	} else {
 		err = errors.New(`JSON error: Missing parameter "memory"`)
 		return preamble, err
 	}
+	if jsonParsed.Exists("wall_time") && jsonParsed.Path("wall_time").Data() != nil {
+		preamble.WallTime, err = wallTimeFromJSON(jsonParsed.Path("wall_time"))
+		if err != nil {
+			return preamble, err
+		}
+	}
 
 	return preamble, nil
 }
@@ -362,6 +541,9 @@ func experimentDetailsFromJSON(jsonParsed *gabs.Container) datamodels.Experiment
 		if experimentJSON.Exists("analysis_id") {
 			experimentDetails.AnalysisID = experimentJSON.Path("analysis_id").Data().(string)
 		}
+		if experimentJSON.Exists("analysis_id_strategy") && experimentJSON.Path("analysis_id_strategy").Data() != nil {
+			experimentDetails.AnalysisIDStrategy = experimentJSON.Path("analysis_id_strategy").Data().(string)
+		}
 		if experimentJSON.Exists("sample_path") && experimentJSON.Path("sample_path").Data() != nil {
 			experimentDetails.SamplePath = experimentJSON.Path("sample_path").Data().(string)
 		}
@@ -409,16 +591,115 @@ func commandPreambleFromJSON(jsonParsed *gabs.Container) (datamodels.CommandPrea
 		return preamble, err
 	}
 	if jsonParsed.Exists("memory") {
-		preamble.Memory = int64(jsonParsed.Path("memory").Data().(float64))
+		preamble.Memory, err = memoryFromJSON(jsonParsed.Path("memory"))
+		if err != nil {
+			return preamble, err
+		}
 	} else {
 		err = errors.New(`JSON error: Missing parameter "memory"`)
 		return preamble, err
 	}
 
+	// Optional overrides of the job's slurm preamble.
+	if jsonParsed.Exists("time") && jsonParsed.Path("time").Data() != nil {
+		preamble.WallTime, err = wallTimeFromJSON(jsonParsed.Path("time"))
+		if err != nil {
+			return preamble, err
+		}
+	}
+	if jsonParsed.Exists("partition") {
+		preamble.Partition = jsonParsed.Path("partition").Data().(string)
+	}
+	if jsonParsed.Exists("account") {
+		preamble.Account = jsonParsed.Path("account").Data().(string)
+	}
+	if jsonParsed.Exists("qos") {
+		preamble.QOS = jsonParsed.Path("qos").Data().(string)
+	}
+	if jsonParsed.Exists("constraint") {
+		preamble.Constraint = jsonParsed.Path("constraint").Data().(string)
+	}
+	if jsonParsed.Exists("exclusive") {
+		preamble.Exclusive = jsonParsed.Path("exclusive").Data().(bool)
+	}
+
 	return preamble, nil
 }
 
-func commandParamsFromJSON(jsonParsed *gabs.Container) (datamodels.CommandParams, error) {
+/* ---
+ * Read a memory quantity given either as a number of megabytes or as a string
+ * with a unit, e.g. "16G".
+ * --- */
+func memoryFromJSON(jsonParsed *gabs.Container) (datamodels.Memory, error) {
+	switch value := jsonParsed.Data().(type) {
+	case float64:
+		return datamodels.ParseMemory(strconv.FormatFloat(value, 'f', -1, 64))
+	case string:
+		return datamodels.ParseMemory(value)
+	}
+	return 0, fmt.Errorf(`JSON error: memory "%v" is not a number or string`, jsonParsed.Data())
+}
+
+/* ---
+ * Read a wall time given either as a number of minutes, as Slurm reads it,
+ * or as a string, e.g. "2-00:00:00" or "36h".
+ * --- */
+func wallTimeFromJSON(jsonParsed *gabs.Container) (datamodels.WallTime, error) {
+	switch value := jsonParsed.Data().(type) {
+	case float64:
+		return datamodels.ParseWallTime(strconv.FormatFloat(value, 'f', -1, 64))
+	case string:
+		return datamodels.ParseWallTime(value)
+	}
+	return 0, fmt.Errorf(`JSON error: wall time "%v" is not a number or string`, jsonParsed.Data())
+}
+
+/* ---
+ * Read the SGE memory request. A resource request such as "virtual_free=4g"
+ * gives the memory per slot. A plain quantity such as "64G" gives the memory
+ * of the whole job, which is requested per slot as h_vmem.
+ * --- */
+func sgeMemoryFromJSON(jsonParsed *gabs.Container, preamble *datamodels.SGEPreamble) error {
+	value, ok := jsonParsed.Data().(string)
+	if !ok {
+		memory, err := memoryFromJSON(jsonParsed)
+		preamble.Memory = memory
+		preamble.MemoryResource = datamodels.SGE_MEMORY_RESOURCE
+		return err
+	}
+
+	// A list of resource requests, e.g. "h_vmem=4G,mem_free=4G". The first
+	// memory request is the memory of the job. Requests that are not memory
+	// are kept as they are.
+	if strings.Contains(value, "=") {
+		for _, request := range strings.Split(value, ",") {
+			request = strings.TrimSpace(request)
+			kv := strings.SplitN(request, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf(`JSON error: sge_preamble memory request "%s" is not resource=value`, request)
+			}
+			resource := strings.TrimSpace(kv[0])
+			perSlot, err := datamodels.ParseMemory(kv[1])
+			switch {
+			case err != nil:
+				preamble.Resources = append(preamble.Resources, request)
+			case preamble.MemoryResource == "":
+				preamble.Memory = perSlot.Times(preamble.Slots())
+				preamble.MemoryResource = resource
+			default:
+				preamble.Resources = append(preamble.Resources, fmt.Sprintf("%s=%s", resource, perSlot))
+			}
+		}
+		return nil
+	}
+
+	memory, err := datamodels.ParseMemory(value)
+	preamble.Memory = memory
+	preamble.MemoryResource = datamodels.SGE_MEMORY_RESOURCE
+	return err
+}
+
+func commandParamsFromJSON(jsonParsed *gabs.Container, defaults datamodels.ContainerParams) (datamodels.CommandParams, error) {
 	var err error
 	var params datamodels.CommandParams
 
@@ -428,25 +709,56 @@ func commandParamsFromJSON(jsonParsed *gabs.Container) (datamodels.CommandParams
 		err = errors.New(`JSON error: Missing parameter "command"`)
 		return params, err
 	}
+
+	// The command may override the job level container settings.
+	params.Container, err = containerFromJSON(jsonParsed, defaults)
+	if err != nil {
+		return params, err
+	}
+
+	// Environment modules and conda environments prepare the host. A command
+	// that uses them without naming an image or a runtime runs on the host.
+	params.Modules = modulesFromJSON(jsonParsed)
+	if jsonParsed.Exists("conda_env") && jsonParsed.Path("conda_env").Data() != nil {
+		params.CondaEnv = jsonParsed.Path("conda_env").Data().(string)
+	}
+	hasImage := jsonParsed.Exists("singularity_image") || params.Container.Image != ""
+	if (len(params.Modules) > 0 || params.CondaEnv != "") && !hasImage && !jsonParsed.Exists("container", "runtime") {
+		params.Container.Runtime = datamodels.RUNTIME_NONE
+	}
+
 	if jsonParsed.Exists("volumes") {
 		volumes := jsonParsed.Path("volumes")
 		params.Volumes = volumesFromJSON(volumes)
-	} else {
+	} else if params.UsesContainer() {
 		err = errors.New(`JSON error: Missing parameter "volumes"`)
 		return params, err
 	}
+
+	// The singularity image is only required when a singularity style runtime
+	// is used without an explicit container image.
+	runtime := params.ContainerRuntime()
+	needsSingularityImage := (runtime == datamodels.RUNTIME_SINGULARITY || runtime == datamodels.RUNTIME_APPTAINER) && params.Container.Image == ""
 	if jsonParsed.Exists("singularity_path") {
 		params.SingularityPath = jsonParsed.Path("singularity_path").Data().(string)
-	} else {
+	} else if needsSingularityImage {
 		err = errors.New(`JSON error: Missing parameter "singularity_path"`)
 		return params, err
 	}
 	if jsonParsed.Exists("singularity_image") {
 		params.SingularityImage = jsonParsed.Path("singularity_image").Data().(string)
-	} else {
+	} else if needsSingularityImage {
 		err = errors.New(`JSON error: Missing parameter "singularity_image"`)
 		return params, err
 	}
+	if (runtime == datamodels.RUNTIME_DOCKER || runtime == datamodels.RUNTIME_PODMAN) && params.ImageReference() == "" {
+		err = fmt.Errorf(`JSON error: Missing parameter "container.image" for %s runtime`, runtime)
+		return params, err
+	}
+	if (runtime == datamodels.RUNTIME_DOCKER || runtime == datamodels.RUNTIME_PODMAN) && params.IsImageURI() && !strings.HasPrefix(params.SourceImage(), "docker://") {
+		err = fmt.Errorf(`JSON error: the %s runtime cannot run image "%s"`, runtime, params.SourceImage())
+		return params, err
+	}
 
 	// Deal with the "optional params"
 	if jsonParsed.Exists("workdir") {
@@ -464,6 +776,115 @@ func commandParamsFromJSON(jsonParsed *gabs.Container) (datamodels.CommandParams
 	return params, nil
 }
 
+/* ---
+ * Parse an optional "container" block, e.g.
+ * "container": {"runtime": "docker", "image": "quay.io/biocontainers/star:2.7.10b--h9ee0642_0"}
+ * Unset fields fall back to the given defaults.
+ * --- */
+func containerFromJSON(jsonParsed *gabs.Container, defaults datamodels.ContainerParams) (datamodels.ContainerParams, error) {
+	var container = defaults
+
+	if !jsonParsed.Exists("container") || jsonParsed.Path("container").Data() == nil {
+		return container, nil
+	}
+	containerJSON := jsonParsed.Path("container")
+
+	if containerJSON.Exists("runtime") {
+		container.Runtime = containerJSON.Path("runtime").Data().(string)
+		if !datamodels.IsSupportedRuntime(container.Runtime) {
+			err := fmt.Errorf(`JSON error: unsupported container runtime "%s". Commander currently supports singularity, apptainer, docker, podman and none`, container.Runtime)
+			return container, err
+		}
+	}
+	if containerJSON.Exists("image") {
+		container.Image = containerJSON.Path("image").Data().(string)
+	}
+	if containerJSON.Exists("sha256") {
+		container.SHA256 = strings.TrimPrefix(containerJSON.Path("sha256").Data().(string), "sha256:")
+	}
+	if containerJSON.Exists("image_dir") {
+		container.ImageDir = containerJSON.Path("image_dir").Data().(string)
+	}
+	if containerJSON.Exists("auto_mount") {
+		container.AutoMount = containerJSON.Path("auto_mount").Data().(bool)
+	}
+
+	// Extract the runtime options.
+	options, err := containerOptionsFromJSON(containerJSON, defaults.Options)
+	if err != nil {
+		return container, err
+	}
+	container.Options = options
+
+	runtime := container.Runtime
+	if (runtime == datamodels.RUNTIME_DOCKER || runtime == datamodels.RUNTIME_PODMAN) && len(container.Options.Overlays) > 0 {
+		err = fmt.Errorf(`JSON error: container overlays are not supported by the %s runtime`, runtime)
+		return container, err
+	}
+	return container, nil
+}
+
+/* ---
+ * Parse the container runtime options, e.g.
+ * "mode": "exec", "env": {"TMPDIR": "/tmp"}, "cleanenv": true, "contain": true,
+ * "nv": false, "overlay": ["/path/overlay.img"], "extra_options": ["--no-home"]
+ * Unset fields fall back to the given defaults. Environment variables are
+ * merged with the defaults.
+ * --- */
+func containerOptionsFromJSON(jsonParsed *gabs.Container, defaults datamodels.ContainerOptions) (datamodels.ContainerOptions, error) {
+	var options = defaults
+	var err error
+
+	if jsonParsed.Exists("mode") {
+		options.Mode = jsonParsed.Path("mode").Data().(string)
+		if options.Mode != datamodels.CONTAINER_MODE_RUN && options.Mode != datamodels.CONTAINER_MODE_EXEC {
+			err = fmt.Errorf(`JSON error: unsupported container mode "%s". Commander currently supports run and exec`, options.Mode)
+			return options, err
+		}
+	}
+
+	options.Env = make(map[string]string)
+	for key, value := range defaults.Env {
+		options.Env[key] = value
+	}
+	if jsonParsed.Exists("env") {
+		for key, c := range jsonParsed.Path("env").ChildrenMap() {
+			options.Env[key] = fmt.Sprint(c.Data())
+		}
+	}
+
+	if jsonParsed.Exists("cleanenv") {
+		options.CleanEnv = jsonParsed.Path("cleanenv").Data().(bool)
+	}
+	if jsonParsed.Exists("contain") {
+		options.Contain = jsonParsed.Path("contain").Data().(bool)
+	}
+	if jsonParsed.Exists("nv") {
+		options.GPU = jsonParsed.Path("nv").Data().(bool)
+	}
+	if jsonParsed.Exists("overlay") {
+		options.Overlays = make([]string, 0)
+		for _, c := range jsonParsed.Path("overlay").Children() {
+			options.Overlays = append(options.Overlays, c.Data().(string))
+		}
+	}
+	if jsonParsed.Exists("extra_options") {
+		options.Extra = make([]string, 0)
+		for _, c := range jsonParsed.Path("extra_options").Children() {
+			options.Extra = append(options.Extra, c.Data().(string))
+		}
+	}
+	return options, nil
+}
+
+func modulesFromJSON(jsonParsed *gabs.Container) []string {
+	var modules = make([]string, 0)
+	for _, c := range jsonParsed.Path("modules").Children() {
+		modules = append(modules, c.Data().(string))
+	}
+	return modules
+}
+
 func commandOptionsFromJSON(jsonParsed *gabs.Container) []string {
 	var options = make([]string, 0)
 	for _, c := range jsonParsed.Path("options").Children() {
@@ -494,52 +915,54 @@ func volumesFromJSON(jsonParsed *gabs.Container) []datamodels.VolumeMount {
 	return volumes
 }
 
-// func cleanupFromJSON(jsonParsed *gabs.Container) ([]datamodels.CleanupAction, error) {
-// 	var err error
-// 	var cleanupActions = make([]datamodels.CleanupAction, 0)
-
-// 	if jsonParsed.Exists("cleanup") {
-// 		children := jsonParsed.Path("cleanup").Children()
-// 		for _, c := range children {
-// 			targets := c.Path("targets").Children()
-// 			for _, t := range targets {
-// 				cua := datamodels.CleanupAction{}
-// 				cua.ToolName = c.Path("tool_name").Data().(string)
-// 				cua.Action = c.Path("action").Data().(string)
-// 				if cua.Action != "rm" && cua.Action != "mv" && cua.Action != "cp" {
-// 					err = fmt.Errorf(`json template error: unsupported clean-up action "%s". Commander currently supports rm, mv and cp`, cua.Action)
-// 					return cleanupActions, err
-// 				}
-// 				// Source is expected for all cleanup actions.
-// 				cua.Source = t.Path("source").Data().(string)
-
-// 				// Destination is required for mv and cp actions.
-// 				if cua.Action == "mv" || cua.Action == "cp" {
-// 					if !t.Exists("destination") {
-// 						err = fmt.Errorf(`json template error: clean-up action "%s" is missing a destination argument`, cua.Action)
-// 						return cleanupActions, err
-// 					}
-// 					cua.Destination = t.Path("destination").Data().(string)
-// 				} else if t.Exists("destination") {
-// 					cua.Destination = t.Path("destination").Data().(string)
-// 				}
-// 				cleanupActions = append(cleanupActions, cua)
-// 			}
-// 		}
-// 	}
-// 	return cleanupActions, nil
-// }
-
-func cleanupFromJSON(jsonParsed *gabs.Container) ([]string, error) {
-	var cleanupActions = make([]string, 0)
-
-	if jsonParsed.Exists("cleanup") {
-		children := jsonParsed.Path("cleanup").Children()
-		for _, c := range children {
-			cleanupActions = append(cleanupActions, c.Data().(string))
-		}
-	}
-	return cleanupActions, nil
+/* ---
+ * Extract the cleanup of the job. A string is written to the job script as
+ * is. An object names an action on files in the output directory of a step,
+ * e.g. {"step": "samtools_index", "action": "mv", "targets": [{"source": "x",
+ * "destination": "y"}]}. "tool_name" may stand in for "step" when exactly one
+ * step runs the tool.
+ * --- */
+func cleanupFromJSON(jsonParsed *gabs.Container) ([]string, []datamodels.CleanupAction, error) {
+	var cleanup = make([]string, 0)
+	var cleanupActions = make([]datamodels.CleanupAction, 0)
+
+	if !jsonParsed.Exists("cleanup") {
+		return cleanup, cleanupActions, nil
+	}
+	for _, c := range jsonParsed.Path("cleanup").Children() {
+		if line, ok := c.Data().(string); ok {
+			cleanup = append(cleanup, line)
+			continue
+		}
+		if _, ok := c.Data().(map[string]interface{}); !ok {
+			return cleanup, cleanupActions, errors.New("JSON error: cleanup entries must be strings or objects")
+		}
+
+		step, _ := c.Path("step").Data().(string)
+		toolName, _ := c.Path("tool_name").Data().(string)
+		action, _ := c.Path("action").Data().(string)
+		if step == "" && toolName == "" {
+			return cleanup, cleanupActions, errors.New(`JSON error: cleanup action needs a "step" or "tool_name"`)
+		}
+		if action != "rm" && action != "mv" && action != "cp" {
+			return cleanup, cleanupActions, fmt.Errorf(`JSON error: unsupported cleanup action "%s". Commander supports rm, mv and cp`, action)
+		}
+
+		for _, t := range c.Path("targets").Children() {
+			cua := datamodels.CleanupAction{Step: step, ToolName: toolName, Action: action}
+			cua.Source, _ = t.Path("source").Data().(string)
+			cua.Destination, _ = t.Path("destination").Data().(string)
+			if cua.Source == "" {
+				return cleanup, cleanupActions, fmt.Errorf(`JSON error: cleanup action "%s" has a target without a source`, action)
+			}
+			// Destination is required for mv and cp actions.
+			if (action == "mv" || action == "cp") && cua.Destination == "" {
+				return cleanup, cleanupActions, fmt.Errorf(`JSON error: cleanup action "%s %s" is missing a destination`, action, cua.Source)
+			}
+			cleanupActions = append(cleanupActions, cua)
+		}
+	}
+	return cleanup, cleanupActions, nil
 }
 
 /* -----------------------------------------------------------------------------
@@ -562,14 +985,23 @@ func setSlurmPreamble(tag, val string, slurmPreamble *datamodels.SlurmPreamble)
 	}
 }
 
-func setCommandPreamble(tag, val string, commandPreamble *datamodels.CommandPreamble) {
+func setCommandPreamble(tag, val string, commandPreamble *datamodels.CommandPreamble) error {
+	var err error
 	if tag == "TASKS" {
-		commandPreamble.Tasks, _ = strconv.ParseInt(val, 10, 64)
+		commandPreamble.Tasks, err = strconv.ParseInt(val, 10, 64)
 	} else if tag == "CPUS" {
-		commandPreamble.CPUs, _ = strconv.ParseInt(val, 10, 64)
+		commandPreamble.CPUs, err = strconv.ParseInt(val, 10, 64)
 	} else if tag == "MEMORY" {
-		commandPreamble.Memory, _ = strconv.ParseInt(val, 10, 64)
+		commandPreamble.Memory, err = datamodels.ParseMemory(val)
+		return err
+	} else if tag == "TIME" {
+		commandPreamble.WallTime, err = datamodels.ParseWallTime(val)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf(`resource error: %s "%s" is not a whole number`, tag, val)
 	}
+	return nil
 }
 
 func setCommandParams(tag, val string, params *datamodels.CommandParams) {
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"reflect"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+)
+
+func TestSGEMemoryFromJSON(t *testing.T) {
+	var tests = []struct {
+		memory    string
+		pe        string
+		want      datamodels.Memory
+		resource  string
+		resources []string
+		valid     bool
+	}{
+		{`"64G"`, "smp 8", 64 * 1024, "h_vmem", nil, true},
+		{`"virtual_free=4G"`, "smp 8", 32 * 1024, "virtual_free", nil, true},
+		{`"h_vmem=4G,mem_free=4G"`, "smp 2", 8 * 1024, "h_vmem", []string{"mem_free=4G"}, true},
+		{`"mem_free=2048M, h_vmem=4g"`, "smp 1", 2048, "mem_free", []string{"h_vmem=4G"}, true},
+		{`"h_vmem=4G,arch=lx-amd64"`, "smp 1", 4096, "h_vmem", []string{"arch=lx-amd64"}, true},
+		{`"arch=lx-amd64"`, "smp 1", 0, "", []string{"arch=lx-amd64"}, true},
+		{`"h_vmem=4G,lots"`, "smp 1", 0, "", nil, false},
+		{`"lots"`, "smp 1", 0, "", nil, false},
+	}
+
+	for _, tt := range tests {
+		parsed, err := gabs.ParseJSON([]byte(tt.memory))
+		if err != nil {
+			t.Fatal(err)
+		}
+		preamble := datamodels.SGEPreamble{ParallelEnv: tt.pe}
+		err = sgeMemoryFromJSON(parsed, &preamble)
+		if (err == nil) != tt.valid {
+			t.Errorf("sgeMemoryFromJSON(%s) error = %v, want valid %v", tt.memory, err, tt.valid)
+			continue
+		}
+		if !tt.valid {
+			continue
+		}
+		if preamble.Memory != tt.want || preamble.MemoryResource != tt.resource || !reflect.DeepEqual(preamble.Resources, tt.resources) {
+			t.Errorf("sgeMemoryFromJSON(%s) = %s %s %v, want %s %s %v", tt.memory, preamble.Memory, preamble.MemoryResource, preamble.Resources, tt.want, tt.resource, tt.resources)
+		}
+	}
+}
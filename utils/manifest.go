@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+/* -----------------------------------------------------------------------------
+ * Writing the provenance manifest of an analysis.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Write <analysis_path>/config/manifest.json. Call this once every script is
+ * written so their hashes are included. Paths are recorded as absolute paths,
+ * so the manifest can be read from any directory.
+ * --- */
+func WriteManifest(job datamodels.Job, paramFile string) error {
+	fmt.Printf("Writing provenance manifest... \n")
+	experiment := job.ExperimentDetails
+
+	manifest := datamodels.Manifest{
+		CommanderVersion: datamodels.VERSION,
+		GeneratedAt:      time.Now().Format(time.RFC3339),
+		User:             currentUser(),
+		Platform:         Platform,
+		AnalysisID:       experiment.AnalysisID,
+		AnalysisPath:     absPath(experiment.PrintAnalysisPath()),
+		Job:              job,
+		Images:           manifestImages(job),
+		Inputs:           make([]datamodels.FileRecord, 0),
+		Scripts:          make([]datamodels.FileRecord, 0),
+	}
+	manifest.Host, _ = os.Hostname()
+
+	// The param and design files are small, so hash them.
+	inputs := []string{paramFile}
+	if experiment.SamplesFile != "" {
+		inputs = append(inputs, experiment.SamplesFile)
+	}
+	for _, path := range inputs {
+		record, err := fileRecord(path, true)
+		if err != nil {
+			return err
+		}
+		manifest.Inputs = append(manifest.Inputs, record)
+	}
+
+	// Read files are only recorded by size and modification time, plus their
+	// sha256 if checksum verification already hashed them.
+	if checksumCache == nil {
+		loadChecksumCache()
+	}
+	for _, sample := range experiment.Samples {
+		reads := []string{sample.DumpForwardReadFileWithPath()}
+		if sample.IsPairedEnd() {
+			reads = append(reads, sample.DumpReverseReadFileWithPath())
+		}
+		for _, path := range reads {
+			record, err := fileRecord(path, false)
+			if err != nil {
+				// Missing reads are reported by preflight.
+				record = datamodels.FileRecord{Path: absPath(path)}
+			} else if info, err := os.Stat(path); err == nil {
+				record.SHA256, _ = cachedChecksum(path, "sha256", info)
+			}
+			manifest.Inputs = append(manifest.Inputs, record)
+		}
+	}
+
+	// Every script written during this run.
+	for _, record := range writtenFiles {
+		if filepath.Dir(record.Path) == OutDir {
+			if record.Path == JobScriptPath(job) {
+				record.Role = datamodels.WORKFLOW_ROLE
+			}
+			record.Path = absPath(record.Path)
+			manifest.Scripts = append(manifest.Scripts, record)
+		}
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	configPath := fmt.Sprintf("%s/config", experiment.PrintAnalysisPath())
+	if err = makeDir(configPath); err != nil {
+		return err
+	}
+	err = writeFile(fmt.Sprintf("%s/%s", configPath, datamodels.MANIFEST_FILE), content)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done.\n\n")
+	return nil
+}
+
+/* ---
+ * Return the images preflight resolved. Without preflight, fall back to the
+ * images and digests given in the param file.
+ * --- */
+func manifestImages(job datamodels.Job) []datamodels.ResolvedImage {
+	if len(resolvedImages) > 0 {
+		return resolvedImages
+	}
+
+	var images = make([]datamodels.ResolvedImage, 0)
+	for _, cmd := range job.Commands {
+		params := cmd.CommandParams
+		if !params.UsesContainer() {
+			continue
+		}
+		images = append(images, datamodels.ResolvedImage{
+			Step:      cmd.StepID(),
+			Runtime:   params.ContainerRuntime(),
+			Reference: params.SourceImage(),
+			Digest:    params.ImageDigest(),
+		})
+	}
+	return images
+}
+
+/* ---
+ * Describe a file for the manifest, hashing it if asked to.
+ * --- */
+func fileRecord(path string, hash bool) (datamodels.FileRecord, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return datamodels.FileRecord{Path: absPath(path)}, err
+	}
+
+	record := datamodels.FileRecord{
+		Path:    absPath(path),
+		Size:    info.Size(),
+		ModTime: info.ModTime().Format(time.RFC3339),
+	}
+	if hash {
+		record.SHA256, err = sha256File(path)
+	}
+	return record, err
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+func currentUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	return u.Username
+}
@@ -3,7 +3,8 @@ package utils
 import (
 	"commander/datamodels"
 	"fmt"
-	"os"
+	"io"
+	"path/filepath"
 	"strings"
 )
 
@@ -12,11 +13,21 @@ import (
  * -------------------------------------------------------------------------- */
 func WriteSlurmJobScript(job datamodels.Job, experiment datamodels.Experiment) error {
 	var err error
+
+	// Every step is its own job, so there is no parent slurm script.
+	if job.Details.IsSeparateSubmission() {
+		return writeSeparateSlurmJobs(job, experiment)
+	}
+
 	fmt.Println("Writing slurm script preamble...")
 
 	// Open the parent slurm file
-	filename := fmt.Sprintf("%s.slurm", job.Details.Name)
-	slurmFile, err := os.Create(filename)
+	err = makeDir(OutDir)
+	if err != nil {
+		return err
+	}
+	filename := JobScriptPath(job)
+	slurmFile, err := createFile(filename)
 	if err != nil {
 		return err
 	}
@@ -70,8 +81,15 @@ func WriteSlurmJobScript(job datamodels.Job, experiment datamodels.Experiment) e
 	// TODO: Revisit this.
 	// The command is not a batch command, write the command to the slurm file
 	// we opened earlier.
+	if !shouldRunStep(cmd, nil) {
+		fmt.Println("Command already completed, not writing it.")
+		writeCleanupActions(slurmFile, job.FormatCleanupActions())
+		return nil
+	}
+	cmd = cmd.Expanded(nil)
 	writeSlurmCommandPreamble(slurmFile, cmd.Preamble)
-	writeSingularityPreamble(slurmFile, cmd)
+	writeEnvironmentSetup(slurmFile, cmd)
+	writeContainerPreamble(slurmFile, cmd)
 	// Write the command we are calling.
 	if cmd.SubCommandName() != "" {
 		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["command"], fmt.Sprintf("%s %s", cmd.CommandName(), cmd.SubCommandName()))))
@@ -80,6 +98,7 @@ func WriteSlurmJobScript(job datamodels.Job, experiment datamodels.Experiment) e
 	}
 	writeCommandOptions(slurmFile, cmd.CommandParams.CommandOptions)
 	writeCommandArgs(slurmFile, cmd.CommandParams.CommandArgs)
+	writeSentinel(slurmFile, cmd.SentinelPath(nil), false)
 	writeCleanupActions(slurmFile, job.FormatCleanupActions())
 	return nil
 }
@@ -93,8 +112,12 @@ func WriteSGEJobScript(job datamodels.Job, experiment datamodels.Experiment) err
 	fmt.Println("Writing sge script preamble...")
 
 	// Open the parent sge script
-	filename := fmt.Sprintf("%s.sh", job.Details.Name)
-	sgeFile, err := os.Create(filename)
+	err = makeDir(OutDir)
+	if err != nil {
+		return err
+	}
+	filename := JobScriptPath(job)
+	sgeFile, err := createFile(filename)
 	if err != nil {
 		return err
 	}
@@ -112,13 +135,14 @@ func WriteSGEJobScript(job datamodels.Job, experiment datamodels.Experiment) err
 	writeMiscPreamble(sgeFile, job.MiscPreamble)
 
 	// If there are multiple commands, it is safe to assume we are generating
-	// a slurm script for a pipeline. Write the command details in a pipeline
+	// a sge script for a pipeline. Write the command details in a pipeline
 	// format.
-	// if len(job.Commands) > 1 {
-	// 	fmt.Println("Writing pipeline slurm script...")
-	// 	err = writePipelineSGEScript(sgeFile, job, experiment)
-	// 	return err
-	// }
+	if len(job.Commands) > 1 {
+		fmt.Println("Writing pipeline sge script...")
+		err = writePipelineSGEScript(sgeFile, job, experiment)
+		writeCleanupActions(sgeFile, job.CleanUp)
+		return err
+	}
 
 	// There is a single command, we will either write this as as single .slurm
 	// file or as a batch slurm file depending on the command definition.
@@ -137,7 +161,14 @@ func WriteSGEJobScript(job datamodels.Job, experiment datamodels.Experiment) err
 	// TODO: Revisit this.
 	// The command is not a batch command, write the command to the slurm file
 	// we opened earlier.
-	writeSingularityPreamble(sgeFile, cmd)
+	if !shouldRunStep(cmd, nil) {
+		fmt.Println("Command already completed, not writing it.")
+		writeCleanupActions(sgeFile, job.CleanUp)
+		return nil
+	}
+	cmd = cmd.Expanded(nil)
+	writeEnvironmentSetup(sgeFile, cmd)
+	writeContainerPreamble(sgeFile, cmd)
 
 	// Write the command we are calling.
 	if cmd.SubCommandName() != "" {
@@ -147,10 +178,45 @@ func WriteSGEJobScript(job datamodels.Job, experiment datamodels.Experiment) err
 	}
 	writeCommandOptions(sgeFile, cmd.CommandParams.CommandOptions)
 	writeCommandArgs(sgeFile, cmd.CommandParams.CommandArgs)
+	writeSentinel(sgeFile, cmd.SentinelPath(nil), false)
 	writeCleanupActions(sgeFile, job.CleanUp)
 	return nil
 }
 
+/* ---
+ * Return the path of a generated script inside the output directory.
+ * --- */
+func scriptPath(name string) string {
+	return filepath.Join(OutDir, name)
+}
+
+/* ---
+ * Return the path of the main job script.
+ * --- */
+func JobScriptPath(job datamodels.Job) string {
+	if Platform == "sge" {
+		return scriptPath(fmt.Sprintf("%s.sh", job.Details.Name))
+	}
+	if job.Details.IsSeparateSubmission() {
+		return scriptPath(fmt.Sprintf("%s_submit.sh", job.Details.Name))
+	}
+	return scriptPath(fmt.Sprintf("%s.slurm", job.Details.Name))
+}
+
+/* ---
+ * Return the command that submits the job script to the cluster.
+ * --- */
+func SubmitCommand(job datamodels.Job) string {
+	if Platform == "sge" {
+		return fmt.Sprintf("qsub %s", JobScriptPath(job))
+	}
+	if job.Details.IsSeparateSubmission() {
+		// The submit script runs sbatch itself.
+		return fmt.Sprintf("bash %s", JobScriptPath(job))
+	}
+	return fmt.Sprintf("sbatch %s", JobScriptPath(job))
+}
+
 /* -----------------------------------------------------------------------------
  * Various helper functions.
  * -------------------------------------------------------------------------- */
@@ -158,13 +224,25 @@ func WriteSGEJobScript(job datamodels.Job, experiment datamodels.Experiment) err
 /* ---
  * Write the slurm job preamble to a .slurm file.
  * --- */
-func writeSlurmJobPreamble(slurmFile *os.File, jobName string, preamble datamodels.SlurmPreamble) {
+func writeSlurmJobPreamble(slurmFile io.Writer, jobName string, preamble datamodels.SlurmPreamble) {
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", datamodels.SLURM_PREAMBLE["header"]))
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["job_name"], jobName)))
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["partition"], preamble.Partition)))
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["notifications"], preamble.NotificationType())))
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["email"], preamble.EmailAddress)))
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["time"], preamble.WallTime)))
+	if preamble.Account != "" {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["account"], preamble.Account)))
+	}
+	if preamble.QOS != "" {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["qos"], preamble.QOS)))
+	}
+	if preamble.Constraint != "" {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["constraint"], preamble.Constraint)))
+	}
+	if preamble.Exclusive {
+		fmt.Fprintln(slurmFile, datamodels.SLURM_PREAMBLE["exclusive"])
+	}
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["job_log"], preamble.JobName)))
 	fmt.Fprintln(slurmFile)
 }
@@ -172,7 +250,7 @@ func writeSlurmJobPreamble(slurmFile *os.File, jobName string, preamble datamode
 /* ---
  * Write the sge job preamble to a batch file.
  * --- */
-func writeSGESubmitScriptPreamble(sgeFile *os.File, preamble datamodels.SGEPreamble) {
+func writeSGESubmitScriptPreamble(sgeFile io.Writer, preamble datamodels.SGEPreamble) {
 	fmt.Fprintln(sgeFile, fmt.Sprintf("%s", datamodels.SGE_PREAMBLE["header"]))
 	/* --- Handle boolean flags in the parameter file. --- */
 	// Use current working directory
@@ -187,25 +265,47 @@ func writeSGESubmitScriptPreamble(sgeFile *os.File, preamble datamodels.SGEPream
 	fmt.Fprintln(sgeFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SGE_PREAMBLE["shell"], preamble.Shell)))
 	fmt.Fprintln(sgeFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SGE_PREAMBLE["email"], preamble.EmailAddress)))
 	fmt.Fprintln(sgeFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SGE_PREAMBLE["parallel_environment"], preamble.ParallelEnv)))
-	fmt.Fprintln(sgeFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SGE_PREAMBLE["memory"], preamble.Memory)))
+	var resources = make([]string, 0)
+	if preamble.MemoryResource != "" {
+		resources = append(resources, fmt.Sprintf("%s=%s", preamble.MemoryResource, preamble.Memory.Per(preamble.Slots())))
+	}
+	resources = append(resources, preamble.Resources...)
+	if len(resources) > 0 {
+		fmt.Fprintln(sgeFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SGE_PREAMBLE["memory"], strings.Join(resources, ","))))
+	}
+	if preamble.WallTime > 0 {
+		fmt.Fprintln(sgeFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SGE_PREAMBLE["time"], preamble.WallTime.HMS())))
+	}
 	fmt.Fprintln(sgeFile)
 }
 
 /* ---
  * Write misc preamble
  * --- */
-func writeMiscPreamble(outfile *os.File, preamble datamodels.MiscPreamble) {
+func writeMiscPreamble(outfile io.Writer, preamble datamodels.MiscPreamble) {
 	for _, line := range preamble.Lines {
 		fmt.Fprintln(outfile, fmt.Sprintf(line))
 	}
 	fmt.Fprintln(outfile)
 }
 
+/* ---
+ * Write the misc preamble into a step script. Step scripts run from a job
+ * script get it from that script, so this only writes when there are lines.
+ * --- */
+func writeStepMiscPreamble(outfile io.Writer, preamble datamodels.MiscPreamble) {
+	if len(preamble.Lines) == 0 {
+		return
+	}
+	fmt.Fprintln(outfile)
+	writeMiscPreamble(outfile, preamble)
+}
+
 /* ---
  * Write intermidate job shit to the slurm file.slurmFile :-)
  * This will probably be omitted in the future.
  *  --- */
-func writeIntermediateJobShit(slurmFile *os.File) {
+func writeIntermediateJobShit(slurmFile io.Writer) {
 	for _, line := range datamodels.INTERMEDIATE_SLURM_SHIT {
 		fmt.Fprintln(slurmFile, line)
 	}
@@ -214,96 +314,463 @@ func writeIntermediateJobShit(slurmFile *os.File) {
 /* ---
  * Write the CPU count to the slurm file.
  * --- */
-func writeJobCPU(slurmFile *os.File, job datamodels.Job) {
+func writeJobCPU(slurmFile io.Writer, job datamodels.Job) {
 	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["cpus"], job.MaxCPUUsage())))
 }
 
 /* ---
  * Write the remaining contents of a pipeline slurm script. This function will
  * also generate the individual bash scripts for the commands being executed.
+ * Steps are written in the order of the job schedule. Steps that share a level
+ * of the schedule do not depend on each other and run side by side.
  * --- */
-func writePipelineSlurmScript(slurmFile *os.File, job datamodels.Job, experiment datamodels.Experiment) error {
+func writePipelineSlurmScript(slurmFile io.Writer, job datamodels.Job, experiment datamodels.Experiment) error {
+	schedule, err := job.Schedule()
+	if err != nil {
+		return err
+	}
+
+	// In per-sample mode each sample runs its own chain of batch steps, so a
+	// slow sample does not hold up the rest.
+	if job.Details.IsPerSample() {
+		return writePerSamplePipelineSlurmScript(slurmFile, schedule, job, experiment)
+	}
+
 	fmt.Println("Writing pipeline scripts...")
-	// Write the bash scripts for each command.
-	for _, cmd := range job.Commands {
+	for _, level := range schedule {
+		err = writeSlurmLevel(slurmFile, level, job, experiment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ---
+ * Write the srun lines for a single level of the job schedule.
+ * --- */
+func writeSlurmLevel(slurmFile io.Writer, level []datamodels.Command, job datamodels.Job, experiment datamodels.Experiment) error {
+	// Batch steps are always launched in the background. Independent steps in
+	// the same level are too.
+	var background = len(level) > 1
+	var needsWait = background
+
+	for _, cmd := range level {
 		if cmd.Batch {
 			// User has indicated the command will be run in a batch format.
-			err := writeBatchCommand(slurmFile, cmd, job, experiment)
+			err := writeBatchSruns(slurmFile, cmd, job, experiment)
 			if err != nil {
 				return err
 			}
-		} else {
+			needsWait = true
+		} else if shouldRunStep(cmd, nil) {
 			fmt.Println("Writing command script...")
 			// Write the bash script for the command.
-			bashScript, err := writeCommandScript(cmd)
+			bashScript, err := writeCommandScript(cmd, datamodels.MiscPreamble{})
 			if err != nil {
 				return err
 			}
 
 			// Write the line for the command in the slurm file.
-			fmt.Fprintln(
-				slurmFile,
-				fmt.Sprintf(
-					"srun --input=none -K1 -N%d -c%d --tasks-per-node=%d -w %s --mem-per-cpu=%d ./%s",
-					cmd.Preamble.Tasks,
-					cmd.Preamble.CPUs,
-					cmd.Preamble.Tasks,
-					job.SlurmPreamble.Partition,
-					cmd.Preamble.Memory,
-					bashScript,
-				),
-			)
+			writeSrunLine(slurmFile, cmd.Preamble, job.SlurmPreamble, bashScript, background)
 			// Make the bash script executable.
-			if err = os.Chmod(bashScript, 0755); err != nil {
+			if err = makeExecutable(bashScript); err != nil {
 				return err
 			}
 		}
 	}
+
+	// Don't start the next level before this one is done.
+	if needsWait {
+		writeWait(slurmFile)
+	}
 	return nil
 }
 
+/* ---
+ * Write the remaining contents of a pipeline sge script. SGE runs the whole
+ * pipeline inside a single job, so each step script is called directly.
+ * Steps are written in the order of the job schedule.
+ * --- */
+func writePipelineSGEScript(sgeFile io.Writer, job datamodels.Job, experiment datamodels.Experiment) error {
+	schedule, err := job.Schedule()
+	if err != nil {
+		return err
+	}
+
+	// In per-sample mode each sample runs its own chain of batch steps, as
+	// for Slurm.
+	if job.Details.IsPerSample() {
+		return writePerSamplePipelineSGEScript(sgeFile, schedule, experiment)
+	}
+
+	fmt.Println("Writing pipeline scripts...")
+	for _, level := range schedule {
+		err = writeSGELevel(sgeFile, level, experiment)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ---
+ * Write the script calls for a single level of the job schedule.
+ * --- */
+func writeSGELevel(sgeFile io.Writer, level []datamodels.Command, experiment datamodels.Experiment) error {
+	var background = len(level) > 1
+	var needsWait = background
+
+	for _, cmd := range level {
+		if cmd.Batch {
+			fmt.Println("Writing batch bash scripts...")
+			for _, sample := range experiment.Samples {
+				if !shouldRunStep(cmd, &sample) {
+					continue
+				}
+				bashScriptName, err := writeCommandScriptForSample(cmd, sample, datamodels.MiscPreamble{})
+				if err != nil {
+					return err
+				}
+				if err = makeExecutable(bashScriptName); err != nil {
+					return err
+				}
+				fmt.Fprintln(sgeFile, fmt.Sprintf("%s&", bashScriptName))
+			}
+			needsWait = true
+			continue
+		}
+
+		if !shouldRunStep(cmd, nil) {
+			continue
+		}
+		fmt.Println("Writing command script...")
+		bashScript, err := writeCommandScript(cmd, datamodels.MiscPreamble{})
+		if err != nil {
+			return err
+		}
+		if err = makeExecutable(bashScript); err != nil {
+			return err
+		}
+		if background {
+			fmt.Fprintln(sgeFile, fmt.Sprintf("%s&", bashScript))
+		} else {
+			fmt.Fprintln(sgeFile, fmt.Sprintf("%s", bashScript))
+		}
+	}
+
+	// Don't start the next level before this one is done.
+	if needsWait {
+		writeWait(sgeFile)
+	}
+	return nil
+}
+
+/* ---
+ * Write the remaining contents of a pipeline sge script in per-sample mode.
+ * Groups of batch levels run as one chain script per sample, launched in the
+ * background. Levels with non-batch commands act as barriers between groups.
+ * --- */
+func writePerSamplePipelineSGEScript(sgeFile io.Writer, schedule [][]datamodels.Command, experiment datamodels.Experiment) error {
+	var groupIndex = 0
+
+	fmt.Println("Writing per-sample pipeline scripts...")
+	for _, group := range splitBatchGroups(schedule) {
+		if !isBatchLevel(group[0]) {
+			err := writeSGELevel(sgeFile, group[0], experiment)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		groupIndex++
+		chains, err := writeChainScripts(group, groupIndex, experiment)
+		if err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			fmt.Fprintln(sgeFile, fmt.Sprintf("%s&", chain))
+		}
+		writeWait(sgeFile)
+	}
+	return nil
+}
+
+/* ---
+ * Write the remaining contents of a pipeline slurm script in per-sample mode.
+ * Consecutive levels made up only of batch commands are grouped into a chain
+ * script per sample. The chains run side by side and are only joined by a
+ * wait block at the end of the group. Levels with non-batch commands act as
+ * barriers between groups.
+ * --- */
+func writePerSamplePipelineSlurmScript(slurmFile io.Writer, schedule [][]datamodels.Command, job datamodels.Job, experiment datamodels.Experiment) error {
+	var groupIndex = 0
+
+	fmt.Println("Writing per-sample pipeline scripts...")
+	for _, group := range splitBatchGroups(schedule) {
+		if !isBatchLevel(group[0]) {
+			err := writeSlurmLevel(slurmFile, group[0], job, experiment)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		groupIndex++
+		chains, err := writeChainScripts(group, groupIndex, experiment)
+		if err != nil {
+			return err
+		}
+		preamble := chainPreamble(group)
+		for _, chain := range chains {
+			writeSrunLine(slurmFile, preamble, job.SlurmPreamble, chain, true)
+		}
+		writeWait(slurmFile)
+	}
+	return nil
+}
+
+/* ---
+ * Split the job schedule for per-sample mode. Consecutive levels made up only
+ * of batch commands form one group. Every other level is a group of its own.
+ * --- */
+func splitBatchGroups(schedule [][]datamodels.Command) [][][]datamodels.Command {
+	var groups = make([][][]datamodels.Command, 0)
+	var group = make([][]datamodels.Command, 0)
+
+	for _, level := range schedule {
+		if isBatchLevel(level) {
+			group = append(group, level)
+			continue
+		}
+		if len(group) > 0 {
+			groups = append(groups, group)
+			group = make([][]datamodels.Command, 0)
+		}
+		groups = append(groups, [][]datamodels.Command{level})
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+/* ---
+ * Check if every command in a level of the schedule is a batch command.
+ * --- */
+func isBatchLevel(level []datamodels.Command) bool {
+	for _, cmd := range level {
+		if !cmd.Batch {
+			return false
+		}
+	}
+	return true
+}
+
+/* ---
+ * Return the resources of a chain of batch levels. The chain runs each level
+ * in turn, so request the largest resources any single level in the group
+ * needs. Steps within a level share the CPUs. Memory is requested per CPU.
+ * The time is the sum of the longest step time of each level, unless a step
+ * sets no time, in which case the chain runs in the job's time.
+ * --- */
+func chainPreamble(group [][]datamodels.Command) datamodels.CommandPreamble {
+	var preamble = datamodels.CommandPreamble{}
+	var timed = true
+	for _, level := range group {
+		var levelCPUs = int64(0)
+		var levelTime = datamodels.WallTime(0)
+		for _, cmd := range level {
+			levelCPUs += cmd.Preamble.CPUs
+			if cmd.Preamble.WallTime == 0 {
+				timed = false
+			}
+			if cmd.Preamble.WallTime > levelTime {
+				levelTime = cmd.Preamble.WallTime
+			}
+			if cmd.Preamble.Tasks > preamble.Tasks {
+				preamble.Tasks = cmd.Preamble.Tasks
+			}
+			if cmd.Preamble.Memory > preamble.Memory {
+				preamble.Memory = cmd.Preamble.Memory
+			}
+		}
+		if levelCPUs > preamble.CPUs {
+			preamble.CPUs = levelCPUs
+		}
+		preamble.WallTime += levelTime
+	}
+	if !timed {
+		preamble.WallTime = 0
+	}
+	return preamble
+}
+
+/* ---
+ * Write one chain script per sample for a group of batch levels, along with
+ * the step scripts it calls. Returns the chain scripts. Samples whose steps
+ * all completed get no chain.
+ * --- */
+func writeChainScripts(group [][]datamodels.Command, groupIndex int, experiment datamodels.Experiment) ([]string, error) {
+	var chains = make([]string, 0)
+
+	fmt.Println("Writing per-sample chain scripts...")
+	for _, sample := range experiment.Samples {
+		var stepScripts = make([][]string, 0)
+		for _, level := range group {
+			var levelScripts = make([]string, 0)
+			for _, cmd := range level {
+				if !shouldRunStep(cmd, &sample) {
+					continue
+				}
+				bashScriptName, err := writeCommandScriptForSample(cmd, sample, datamodels.MiscPreamble{})
+				if err != nil {
+					return chains, err
+				}
+				if err = makeExecutable(bashScriptName); err != nil {
+					return chains, err
+				}
+				levelScripts = append(levelScripts, bashScriptName)
+			}
+			if len(levelScripts) > 0 {
+				stepScripts = append(stepScripts, levelScripts)
+			}
+		}
+
+		// Every step already completed for this sample.
+		if len(stepScripts) == 0 {
+			continue
+		}
+
+		chainScript, err := writeChainScript(stepScripts, groupIndex, sample)
+		if err != nil {
+			return chains, err
+		}
+		if err = makeExecutable(chainScript); err != nil {
+			return chains, err
+		}
+		chains = append(chains, chainScript)
+	}
+	return chains, nil
+}
+
+/* ---
+ * Write a chain script that runs the step scripts for a single sample level
+ * by level. Scripts within a level run side by side. The chain stops at the
+ * first failing step.
+ * --- */
+func writeChainScript(stepScripts [][]string, groupIndex int, sample datamodels.Sample) (string, error) {
+	scriptName := scriptPath(fmt.Sprintf("chain%d_%s.sh", groupIndex, sample.Prefix))
+	outfile, err := createFile(scriptName)
+	if err != nil {
+		return scriptName, err
+	}
+	defer outfile.Close()
+
+	fmt.Fprintln(outfile, fmt.Sprintf("#!/bin/bash\n"))
+	for _, level := range stepScripts {
+		if len(level) == 1 {
+			fmt.Fprintln(outfile, fmt.Sprintf("%s || exit 1", level[0]))
+			continue
+		}
+		fmt.Fprintln(outfile, `pids=""`)
+		for _, script := range level {
+			fmt.Fprintln(outfile, fmt.Sprintf(`%s & pids="$pids $!"`, script))
+		}
+		fmt.Fprintln(outfile, `for pid in $pids; do wait $pid || exit 1; done`)
+	}
+	return scriptName, nil
+}
+
+/* ---
+ * Write a single srun line for a script to the slurm file. The job step is
+ * named after the script so its accounting and logs can be told apart. Steps
+ * run inside the job's allocation, so only the step settings that apply to a
+ * job step (time, constraint and exclusive) are passed on.
+ * --- */
+func writeSrunLine(slurmFile io.Writer, preamble datamodels.CommandPreamble, jobPreamble datamodels.SlurmPreamble, script string, background bool) {
+	var options = make([]string, 0)
+	if preamble.WallTime > 0 {
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["time"], preamble.WallTime))
+	}
+	if preamble.Constraint != "" {
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["constraint"], preamble.Constraint))
+	}
+	if preamble.Exclusive {
+		options = append(options, datamodels.STEP_OPTIONS["exclusive"])
+	}
+	options = append(options, script)
+
+	line := fmt.Sprintf(
+		"srun --input=none -K1 -J %s -N%d -c%d --tasks-per-node=%d -p %s --mem-per-cpu=%s %s",
+		strings.TrimSuffix(filepath.Base(script), ".sh"),
+		preamble.Tasks,
+		preamble.CPUs,
+		preamble.Tasks,
+		jobPreamble.Partition,
+		preamble.Memory,
+		strings.Join(options, " "),
+	)
+	if background {
+		line += "&"
+	}
+	fmt.Fprintln(slurmFile, line)
+}
+
 /* ---
  * Finish writing slurm file given a single batch command.
  * --- */
-func writeBatchCommand(slurmFile *os.File, cmd datamodels.Command, job datamodels.Job, experiment datamodels.Experiment) error {
+func writeBatchCommand(slurmFile io.Writer, cmd datamodels.Command, job datamodels.Job, experiment datamodels.Experiment) error {
+	err := writeBatchSruns(slurmFile, cmd, job, experiment)
+	if err != nil {
+		return err
+	}
+	// Write a wait block to the slurm file. Don't want the parent script to
+	// exit before the children.
+	writeWait(slurmFile)
+	return nil
+}
+
+/* ---
+ * Write the per-sample scripts for a batch command and launch each of them in
+ * the background.
+ * --- */
+func writeBatchSruns(slurmFile io.Writer, cmd datamodels.Command, job datamodels.Job, experiment datamodels.Experiment) error {
 	fmt.Println("Command is a batch command.")
 	fmt.Println("Writing batch bash scripts...")
 	for _, sample := range experiment.Samples {
+		if !shouldRunStep(cmd, &sample) {
+			continue
+		}
+
 		// Write the command details to a bash script.
-		bashScriptName, err := writeCommandScriptForSample(cmd, sample)
+		bashScriptName, err := writeCommandScriptForSample(cmd, sample, datamodels.MiscPreamble{})
+		if err != nil {
+			return err
+		}
 
 		// Make the bash script executable.
-		if err = os.Chmod(bashScriptName, 0755); err != nil {
+		if err = makeExecutable(bashScriptName); err != nil {
 			return err
 		}
 
 		// Write the script line for the tool in the slurm file.
-		fmt.Fprintln(
-			slurmFile,
-			fmt.Sprintf(
-				"srun --input=none -K1 -N%d -c%d --tasks-per-node=%d -w %s --mem-per-cpu=%d ./%s&",
-				cmd.Preamble.Tasks,
-				cmd.Preamble.CPUs,
-				cmd.Preamble.Tasks,
-				job.SlurmPreamble.Partition,
-				cmd.Preamble.Memory,
-				bashScriptName,
-			),
-		)
+		writeSrunLine(slurmFile, cmd.Preamble, job.SlurmPreamble, bashScriptName, true)
 	}
-	// Write a wait block to the slurm file. Don't want the parent script to
-	// exit before the children.
-	writeWait(slurmFile)
 	return nil
 }
 
 /* ---
  * Write the command to a bash file.
  * --- */
-func writeCommandScript(command datamodels.Command) (string, error) {
+func writeCommandScript(command datamodels.Command, misc datamodels.MiscPreamble) (string, error) {
+	// Resolve any input placeholders in the options and arguments.
+	command = command.Expanded(nil)
+
 	// Write a bash script for each sample.
-	scriptName := fmt.Sprintf("%s.sh", command.CommandName())
-	outfile, err := os.Create(scriptName)
+	scriptName := scriptPath(fmt.Sprintf("%s.sh", command.StepID()))
+	outfile, err := createFile(scriptName)
 	if err != nil {
 		return scriptName, err
 	}
@@ -311,11 +778,14 @@ func writeCommandScript(command datamodels.Command) (string, error) {
 	// Defer the file closing until the function returns.
 	defer outfile.Close()
 
-	// Write the script header.
+	// Write the script header, and the misc preamble when the script runs as
+	// its own job.
 	writeBashScriptHeader(outfile)
+	writeStepMiscPreamble(outfile, misc)
 
-	// Write singularity preamble.
-	writeSingularityPreamble(outfile, command)
+	// Prepare the host environment and write container preamble.
+	writeEnvironmentSetup(outfile, command)
+	writeContainerPreamble(outfile, command)
 
 	// Write the command we are calling.
 	if command.SubCommandName() != "" {
@@ -328,37 +798,136 @@ func writeCommandScript(command datamodels.Command) (string, error) {
 	writeCommandOptions(outfile, command.CommandParams.CommandOptions)
 	writeCommandArgs(outfile, command.CommandParams.CommandArgs)
 
+	// Mark the step as complete once the command succeeds.
+	writeSentinel(outfile, command.SentinelPath(nil), true)
+
 	return scriptName, nil
 }
 
 /* ---
  * Write bash script header to a file.
  * --- */
-func writeBashScriptHeader(outfile *os.File) {
+func writeBashScriptHeader(outfile io.Writer) {
 	// Write the script header.
 	fmt.Fprintln(outfile, fmt.Sprintf("#!/bin/bash\n"))
 	fmt.Fprintln(outfile, "ulimit -n 10000")
 }
 
 /* ---
- * Write singularity preamble for the command we are calling.
+ * Load any environment modules and activate any conda environment the command
+ * declares. Environment files are built once under the analysis directory.
  * --- */
-func writeSingularityPreamble(outfile *os.File, cmd datamodels.Command) {
+func writeEnvironmentSetup(outfile io.Writer, cmd datamodels.Command) {
+	params := cmd.CommandParams
+	for _, module := range params.Modules {
+		fmt.Fprintln(outfile, fmt.Sprintf(datamodels.ENVIRONMENT_SHIT["module_load"], module))
+	}
+	if params.CondaEnv == "" {
+		return
+	}
+
+	fmt.Fprintln(outfile, datamodels.ENVIRONMENT_SHIT["conda_init"])
+	if params.IsCondaEnvFile() {
+		prefix := params.CondaEnvPrefix(filepath.Dir(cmd.HostOutputPath))
+		fmt.Fprintln(outfile, fmt.Sprintf(datamodels.ENVIRONMENT_SHIT["conda_create"], filepath.Dir(prefix), prefix, prefix, prefix, params.CondaEnv))
+		fmt.Fprintln(outfile, fmt.Sprintf(datamodels.ENVIRONMENT_SHIT["conda_activate"], prefix))
+	} else {
+		fmt.Fprintln(outfile, fmt.Sprintf(datamodels.ENVIRONMENT_SHIT["conda_activate"], params.CondaEnv))
+	}
+}
+
+/* ---
+ * Write the container preamble for the command we are calling. Commands that
+ * run on the host get no preamble.
+ * --- */
+func writeContainerPreamble(outfile io.Writer, cmd datamodels.Command) {
+	switch cmd.CommandParams.ContainerRuntime() {
+	case datamodels.RUNTIME_SINGULARITY, datamodels.RUNTIME_APPTAINER:
+		writeSingularityPreamble(outfile, cmd)
+	case datamodels.RUNTIME_DOCKER, datamodels.RUNTIME_PODMAN:
+		writeDockerPreamble(outfile, cmd)
+	}
+}
+
+/* ---
+ * Write singularity preamble for the command we are calling. Apptainer takes
+ * the same arguments.
+ * --- */
+func writeSingularityPreamble(outfile io.Writer, cmd datamodels.Command) {
+	options := cmd.CommandParams.Container.Options
+
 	// Write singularity shit.
-	fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["singularity_cmd"]))
-	fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_bind"], cmd.CommandParams.PrintMountString())))
+	fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_cmd"], cmd.CommandParams.ContainerRuntime(), options.ContainerMode())))
+	if options.CleanEnv {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["singularity_cleanenv"]))
+	}
+	if options.Contain {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["singularity_contain"]))
+	}
+	if options.GPU {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["singularity_gpu"]))
+	}
+	for _, env := range options.SortedEnv() {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_env"], env)))
+	}
+	for _, overlay := range options.Overlays {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_overlay"], overlay)))
+	}
+	for _, extra := range options.Extra {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["container_option"], extra)))
+	}
+	if len(cmd.CommandParams.Volumes) > 0 {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_bind"], cmd.CommandParams.PrintMountString())))
+	}
 	if cmd.CommandParams.WorkDir != "" {
 		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_workdir"], cmd.CommandParams.WorkDir)))
 
 	}
-	// fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_env"], cmd.CommandParams.SingularityImage)))
-	fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["singularity_env"], cmd.CommandParams.SingularityPath, cmd.CommandParams.SingularityImage)))
+	fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["container_image"], cmd.CommandParams.ImageReference())))
+}
+
+/* ---
+ * Write docker preamble for the command we are calling. Podman takes the same
+ * arguments. The container runs as the calling user so outputs are not owned
+ * by root. Docker containers never inherit the host environment and are
+ * always contained, so cleanenv and contain need no flags. Exec mode clears
+ * the image entrypoint.
+ * --- */
+func writeDockerPreamble(outfile io.Writer, cmd datamodels.Command) {
+	runtime := cmd.CommandParams.ContainerRuntime()
+	options := cmd.CommandParams.Container.Options
+
+	fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["docker_cmd"], runtime)))
+	if runtime == datamodels.RUNTIME_PODMAN {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["podman_user"]))
+	} else {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["docker_user"]))
+	}
+	if options.ContainerMode() == datamodels.CONTAINER_MODE_EXEC {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["docker_entrypoint"]))
+	}
+	if options.GPU {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", datamodels.JOB_SHIT["docker_gpu"]))
+	}
+	for _, env := range options.SortedEnv() {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["docker_env"], env)))
+	}
+	for _, extra := range options.Extra {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["container_option"], extra)))
+	}
+	for _, v := range cmd.CommandParams.Volumes {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["docker_volume"], v.MountString())))
+	}
+	if cmd.CommandParams.WorkDir != "" {
+		fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["docker_workdir"], cmd.CommandParams.WorkDir)))
+	}
+	fmt.Fprintln(outfile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.JOB_SHIT["container_image"], cmd.CommandParams.ImageReference())))
 }
 
 /* ---
  * Format and write STAR specific options.
  * --- */
-func writeStarCommandOptions(outfile *os.File, command datamodels.Command, sample datamodels.Sample) {
+func writeStarCommandOptions(outfile io.Writer, command datamodels.Command, sample datamodels.Sample) {
 	// Star has specific formatting for certain options. Write them here.
 	for _, opt := range command.CommandParams.CommandOptions {
 		chunks := strings.Split(opt, " ")
@@ -381,7 +950,7 @@ func writeStarCommandOptions(outfile *os.File, command datamodels.Command, sampl
 /* ---
  * Format and write trim_galore specific options.
  * --- */
-func writeTrimGaloreCommandOptions(outfile *os.File, command datamodels.Command, sample datamodels.Sample) {
+func writeTrimGaloreCommandOptions(outfile io.Writer, command datamodels.Command, sample datamodels.Sample) {
 	// TrimGalore has specific formatting for certain options. Write them here.
 	for _, opt := range command.CommandParams.CommandOptions {
 		chunks := strings.Split(opt, " ")
@@ -395,12 +964,12 @@ func writeTrimGaloreCommandOptions(outfile *os.File, command datamodels.Command,
 /* ---
  * Format and write kallisto specific options.
  * --- */
-func writeKallistoQuantOptions(outfile *os.File, command datamodels.Command, sample datamodels.Sample) {
+func writeKallistoQuantOptions(outfile io.Writer, command datamodels.Command, sample datamodels.Sample) {
 	for _, opt := range command.CommandParams.CommandOptions {
 		chunks := strings.Split(opt, " ")
 		if chunks[0] == "--output-dir" {
 			// Create the sample name directory.
-			basePath := fmt.Sprintf("%s_quant/%s", command.OutputPathPrefix, sample.Prefix)
+			basePath := fmt.Sprintf("%s/%s", command.OutputPathPrefix, sample.Prefix)
 			// os.Mkdir(basePath, 0775)
 			// Format the output option for kallisto quant
 			opt = fmt.Sprintf("%s", basePath)
@@ -412,7 +981,7 @@ func writeKallistoQuantOptions(outfile *os.File, command datamodels.Command, sam
 /* ---
  * Format and write trim_galore specific arguments.
  * --- */
-func writeTrimGaloreArguments(outfile *os.File, command datamodels.Command, sample datamodels.Sample) {
+func writeTrimGaloreArguments(outfile io.Writer, command datamodels.Command, sample datamodels.Sample) {
 	// Write the forward read file arg to the script.
 	arg := fmt.Sprintf("%s/%s", command.InputPathPrefix, sample.DumpForwardReadFile(false))
 	writeCommandArg(outfile, arg)
@@ -427,7 +996,7 @@ func writeTrimGaloreArguments(outfile *os.File, command datamodels.Command, samp
 /* ---
  * Format and write rsem specific arguments.
  * --- */
-func writeRSEMArguments(outfile *os.File, command datamodels.Command, sample datamodels.Sample) {
+func writeRSEMArguments(outfile io.Writer, command datamodels.Command, sample datamodels.Sample) {
 	// TODO: Revisit this. It can be improved.
 	// First, we will write the readfiles argument.
 	// We want trimmed reads here. So drop the file extention from the readfile name.
@@ -453,7 +1022,7 @@ func writeRSEMArguments(outfile *os.File, command datamodels.Command, sample dat
 /* ---
  * Format and write fastqc specific arguments.
  * --- */
-func writeFastQCArguments(outfile *os.File, sample datamodels.Sample) {
+func writeFastQCArguments(outfile io.Writer, sample datamodels.Sample) {
 	sequenceFilesArg := sample.DumpReadFiles()
 	writeCommandArg(outfile, sequenceFilesArg)
 }
@@ -461,7 +1030,7 @@ func writeFastQCArguments(outfile *os.File, sample datamodels.Sample) {
 /* ---
  * Format and write kallisto quant specific arguments.
  * --- */
-func writeKallistoQuantArguments(outfile *os.File, command datamodels.Command, sample datamodels.Sample) {
+func writeKallistoQuantArguments(outfile io.Writer, command datamodels.Command, sample datamodels.Sample) {
 	noExt := true
 	forwardReads := fmt.Sprintf("%s/%s_val_1.fq.gz", command.InputPathPrefix, sample.DumpForwardReadFile(noExt))
 	reverseReads := fmt.Sprintf("%s/%s_val_2.fq.gz", command.InputPathPrefix, sample.DumpReverseReadFile(noExt))
@@ -472,7 +1041,7 @@ func writeKallistoQuantArguments(outfile *os.File, command datamodels.Command, s
 /* ---
  * Format and write samtools index specific arguments.
  * --- */
-func writeSamtoolsIndexArguments(outfile *os.File, command datamodels.Command, sample datamodels.Sample) {
+func writeSamtoolsIndexArguments(outfile io.Writer, command datamodels.Command, sample datamodels.Sample) {
 	noExt := true
 	forwardReads := fmt.Sprintf("%s/%s_val_1.fq.gz", command.InputPathPrefix, sample.DumpForwardReadFile(noExt))
 	reverseReads := fmt.Sprintf("%s/%s_val_2.fq.gz", command.InputPathPrefix, sample.DumpReverseReadFile(noExt))
@@ -483,9 +1052,12 @@ func writeSamtoolsIndexArguments(outfile *os.File, command datamodels.Command, s
 /* ---
  * Write a command script for a given command given a particular sample.
  *  --- */
-func writeCommandScriptForSample(command datamodels.Command, sample datamodels.Sample) (string, error) {
-	outfileName := fmt.Sprintf("%s_%s.sh", command.CommandName(), sample.Prefix)
-	outfile, err := os.Create(outfileName)
+func writeCommandScriptForSample(command datamodels.Command, sample datamodels.Sample, misc datamodels.MiscPreamble) (string, error) {
+	// Resolve any input and sample placeholders in the options and arguments.
+	command = command.Expanded(&sample)
+
+	outfileName := scriptPath(fmt.Sprintf("%s_%s.sh", command.StepID(), sample.Prefix))
+	outfile, err := createFile(outfileName)
 	if err != nil {
 		return outfileName, err
 	}
@@ -493,11 +1065,14 @@ func writeCommandScriptForSample(command datamodels.Command, sample datamodels.S
 	// Defer file closing until after the function returns.
 	defer outfile.Close()
 
-	// Write the header lines to the bash script.
+	// Write the header lines to the bash script, and the misc preamble when the
+	// script runs as its own job.
 	writeBashScriptHeader(outfile)
+	writeStepMiscPreamble(outfile, misc)
 
-	// Write the singularity command preamble.
-	writeSingularityPreamble(outfile, command)
+	// Prepare the host environment and write the container command preamble.
+	writeEnvironmentSetup(outfile, command)
+	writeContainerPreamble(outfile, command)
 
 	// Write the command we are calling. If there is a subcommand (e.g., kallisto "quant") include it!
 	if command.SubCommandName() != "" {
@@ -541,23 +1116,45 @@ func writeCommandScriptForSample(command datamodels.Command, sample datamodels.S
 		// Otherwise, write the arguments as they were provided.
 		writeCommandArgs(outfile, command.CommandParams.CommandArgs)
 	}
+
+	// Mark the step as complete for this sample once the command succeeds.
+	writeSentinel(outfile, command.SentinelPath(&sample), true)
 	return outfileName, nil
 }
 
 /* ---
- * Write the command preamble to a .slurm file.
+ * Write the command preamble to a .slurm file. Settings the command sets come
+ * after the job preamble, so they override it.
  * --- */
-func writeSlurmCommandPreamble(slurmFile *os.File, preamble datamodels.CommandPreamble) {
-	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["tasks"], preamble.Tasks)))
-	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["cpus"], preamble.CPUs)))
-	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.SLURM_PREAMBLE["memory"], preamble.Memory)))
+func writeSlurmCommandPreamble(slurmFile io.Writer, preamble datamodels.CommandPreamble) {
+	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["tasks"], preamble.Tasks)))
+	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["cpus"], preamble.CPUs)))
+	fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["memory"], preamble.Memory)))
+	if preamble.WallTime > 0 {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["time"], preamble.WallTime)))
+	}
+	if preamble.Partition != "" {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["partition"], preamble.Partition)))
+	}
+	if preamble.Account != "" {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["account"], preamble.Account)))
+	}
+	if preamble.QOS != "" {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["qos"], preamble.QOS)))
+	}
+	if preamble.Constraint != "" {
+		fmt.Fprintln(slurmFile, fmt.Sprintf("%s", fmt.Sprintf(datamodels.COMMAND_PREAMBLE["constraint"], preamble.Constraint)))
+	}
+	if preamble.Exclusive {
+		fmt.Fprintln(slurmFile, datamodels.COMMAND_PREAMBLE["exclusive"])
+	}
 	fmt.Fprintln(slurmFile)
 }
 
 /* --
  * Write all command options to file.
  * --- */
-func writeCommandOptions(outfile *os.File, options []string) {
+func writeCommandOptions(outfile io.Writer, options []string) {
 	// Write all command options.
 	for _, opt := range options {
 		fmt.Fprintln(outfile, fmt.Sprintf("%s \\", opt))
@@ -567,7 +1164,7 @@ func writeCommandOptions(outfile *os.File, options []string) {
 /* --
  * Write a single command option to file.
  * --- */
-func writeCommandOption(outfile *os.File, option string) {
+func writeCommandOption(outfile io.Writer, option string) {
 	// Write a single command option to the file
 	fmt.Fprintln(outfile, fmt.Sprintf("%s \\", option))
 }
@@ -575,7 +1172,7 @@ func writeCommandOption(outfile *os.File, option string) {
 /* ---
  * Write all command args to file.
  * --- */
-func writeCommandArgs(outfile *os.File, args []string) {
+func writeCommandArgs(outfile io.Writer, args []string) {
 	// Write all command options.
 	for _, arg := range args {
 		fmt.Fprintln(outfile, fmt.Sprintf("%s \\", arg))
@@ -585,7 +1182,7 @@ func writeCommandArgs(outfile *os.File, args []string) {
 /* ---
  * Write a single command arg to a file.
  * --- */
-func writeCommandArg(outfile *os.File, arg string) {
+func writeCommandArg(outfile io.Writer, arg string) {
 	// Write a single command arg.
 	fmt.Fprintln(outfile, fmt.Sprintf("%s \\", arg))
 }
@@ -593,15 +1190,27 @@ func writeCommandArg(outfile *os.File, arg string) {
 /* ---
  * Write a single wait block to the slurm file.
  * --- */
-func writeWait(outfile *os.File) {
+func writeWait(outfile io.Writer) {
 	// Write a single command arg.
 	fmt.Fprintln(outfile, "wait")
 }
 
+/* ---
+ * Write the lines that touch the completion sentinel for a step. Step scripts
+ * exit with the status of the command. Job scripts carry on to any cleanup.
+ * --- */
+func writeSentinel(outfile io.Writer, sentinel string, exit bool) {
+	fmt.Fprintln(outfile, datamodels.STEP_SENTINEL["status"])
+	fmt.Fprintln(outfile, fmt.Sprintf(datamodels.STEP_SENTINEL["touch"], filepath.Dir(sentinel), sentinel))
+	if exit {
+		fmt.Fprintln(outfile, datamodels.STEP_SENTINEL["exit"])
+	}
+}
+
 /* ---
  * Write any cleanup actions to the job script.
  * --- */
-func writeCleanupActions(outfile *os.File, actions []string) {
+func writeCleanupActions(outfile io.Writer, actions []string) {
 	for _, a := range actions {
 		fmt.Fprintln(outfile, fmt.Sprintf("%s", a))
 	}
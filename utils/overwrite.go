@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Set from the --overwrite and --increment-analysis-id command line flags.
+var Overwrite bool
+var IncrementAnalysisID bool
+
+/* -----------------------------------------------------------------------------
+ * Protect the output of earlier analyses from being overwritten.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Bump the analysis ID until it names an analysis directory that is missing or
+ * empty. Only used with --increment-analysis-id.
+ * --- */
+func NextFreeAnalysisID(experiment *datamodels.Experiment) error {
+	if !IncrementAnalysisID {
+		return nil
+	}
+
+	original := experiment.AnalysisID
+	for {
+		entries, err := ioutil.ReadDir(experiment.PrintAnalysisPath())
+		if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+			break
+		} else if err != nil {
+			return err
+		}
+		experiment.IncrementAnalysisID()
+	}
+
+	if experiment.AnalysisID != original {
+		fmt.Printf("Analysis ID %s is in use. Using analysis ID %s.\n\n", original, experiment.AnalysisID)
+	}
+	return nil
+}
+
+/* ---
+ * Check for output an earlier run left in the step output directories. Any
+ * sentinel or result file would be overwritten, so commander stops unless
+ * --overwrite or --resume is given.
+ * --- */
+func testExistingOutputs(job datamodels.Job) error {
+	var existing = make([]string, 0)
+
+	for _, cmd := range job.Commands {
+		entries, err := ioutil.ReadDir(cmd.HostOutputPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			existing = append(existing, fmt.Sprintf("%s/%s", cmd.HostOutputPath, entry.Name()))
+		}
+	}
+
+	if len(existing) == 0 {
+		return nil
+	}
+
+	if Overwrite || Resume {
+		preflightWarning("%d existing files under %s may be overwritten.", len(existing), job.ExperimentDetails.PrintAnalysisPath())
+		return nil
+	}
+
+	fmt.Print("The following existing outputs would be overwritten...\n\n")
+	fmt.Println(strings.Join(existing, "\n"))
+	fmt.Println()
+	return fmt.Errorf(
+		"Output error. Analysis %s already has output. Rerun with --resume to skip completed steps, --overwrite to replace the output or --increment-analysis-id to start a new analysis.",
+		job.ExperimentDetails.PrintAnalysisPath(),
+	)
+}
@@ -0,0 +1,281 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RO-Crate version the package conforms to.
+const RO_CRATE_CONTEXT = "https://w3id.org/ro/crate/1.1/context"
+const RO_CRATE_SPEC = "https://w3id.org/ro/crate/1.1"
+const RO_CRATE_METADATA_FILE = "ro-crate-metadata.json"
+
+// A single entity in the RO-Crate @graph.
+type crateEntity map[string]interface{}
+
+/* -----------------------------------------------------------------------------
+ * Packaging a finished analysis as an RO-Crate.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Describe an analysis directory as an RO-Crate. The analysis directory is the
+ * crate root. Everything is read from the provenance manifest and the
+ * directory itself, so no network access is needed.
+ * --- */
+func PackageAnalysis(analysisPath string) error {
+	analysisPath, err := filepath.Abs(analysisPath)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(analysisPath, "config", datamodels.MANIFEST_FILE)
+	content, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("package error: could not read %s. Was the analysis generated by commander? %s", manifestPath, err.Error())
+	}
+	var manifest datamodels.Manifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return fmt.Errorf("package error: could not parse %s: %s", manifestPath, err.Error())
+	}
+
+	fmt.Printf("Packaging analysis %s as an RO-Crate...\n", analysisPath)
+	var graph = make([]crateEntity, 0)
+	var parts = make([]interface{}, 0)
+
+	// The archived configuration.
+	configEntries, err := ioutil.ReadDir(filepath.Join(analysisPath, "config"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range configEntries {
+		if entry.IsDir() {
+			continue
+		}
+		id := filepath.Join("config", entry.Name())
+		graph = append(graph, crateEntity{
+			"@id":            id,
+			"@type":          "File",
+			"name":           entry.Name(),
+			"contentSize":    fmt.Sprintf("%d", entry.Size()),
+			"dateModified":   entry.ModTime().Format(time.RFC3339),
+			"encodingFormat": encodingFormat(entry.Name()),
+		})
+		parts = append(parts, ref(id))
+	}
+
+	// The input samples. Raw reads live outside the crate.
+	var inputs = make([]interface{}, 0)
+	for _, input := range manifest.Inputs {
+		id := crateID(analysisPath, input.Path)
+		entity := crateEntity{
+			"@id":         id,
+			"@type":       "File",
+			"name":        filepath.Base(input.Path),
+			"contentSize": fmt.Sprintf("%d", input.Size),
+		}
+		if input.ModTime != "" {
+			entity["dateModified"] = input.ModTime
+		}
+		if input.SHA256 != "" {
+			entity["sha256"] = input.SHA256
+		}
+		graph = append(graph, entity)
+		inputs = append(inputs, ref(id))
+	}
+
+	// The software containers.
+	var images = make(map[string]string)
+	for _, image := range manifest.Images {
+		id := fmt.Sprintf("#container-%s", image.Step)
+		entity := crateEntity{
+			"@id":            id,
+			"@type":          "ContainerImage",
+			"name":           image.Reference,
+			"additionalType": ref(containerImageType(image.Runtime)),
+		}
+		if image.Digest != "" {
+			entity["sha256"] = strings.TrimPrefix(image.Digest, "sha256:")
+		}
+		graph = append(graph, entity)
+		images[image.Step] = id
+	}
+
+	// The workflow steps, their tools and output directories.
+	schedule, err := manifest.Job.Schedule()
+	if err != nil {
+		return err
+	}
+	var steps = make([]interface{}, 0)
+	var position = 0
+	for _, level := range schedule {
+		for _, cmd := range level {
+			position++
+			stepID := fmt.Sprintf("#step-%s", cmd.StepID())
+			toolID := fmt.Sprintf("#tool-%s", cmd.StepID())
+
+			name := cmd.CommandName()
+			if cmd.SubCommandName() != "" {
+				name = fmt.Sprintf("%s %s", name, cmd.SubCommandName())
+			}
+			tool := crateEntity{
+				"@id":   toolID,
+				"@type": "SoftwareApplication",
+				"name":  name,
+			}
+			if image, ok := images[cmd.StepID()]; ok {
+				tool["softwareRequirements"] = ref(image)
+			}
+
+			step := crateEntity{
+				"@id":         stepID,
+				"@type":       "HowToStep",
+				"name":        cmd.StepID(),
+				"position":    position,
+				"workExample": ref(toolID),
+			}
+			outputDir := cmd.StepID() + "/"
+			if info, err := os.Stat(filepath.Join(analysisPath, cmd.StepID())); err == nil && info.IsDir() {
+				graph = append(graph, crateEntity{
+					"@id":   outputDir,
+					"@type": "Dataset",
+					"name":  fmt.Sprintf("Output of step %s", cmd.StepID()),
+				})
+				parts = append(parts, ref(outputDir))
+				step["result"] = ref(outputDir)
+			}
+			graph = append(graph, tool, step)
+			steps = append(steps, ref(stepID))
+		}
+	}
+
+	// The generated scripts. The job script is the workflow itself.
+	var workflowID string
+	var workflow crateEntity
+	var scripts = make([]interface{}, 0)
+	for _, script := range manifest.Scripts {
+		id := crateID(analysisPath, script.Path)
+		entity := crateEntity{
+			"@id":         id,
+			"@type":       "File",
+			"name":        filepath.Base(script.Path),
+			"contentSize": fmt.Sprintf("%d", script.Size),
+			"sha256":      script.SHA256,
+		}
+		if script.Role == datamodels.WORKFLOW_ROLE {
+			workflowID = id
+			workflow = entity
+			continue
+		}
+		graph = append(graph, entity)
+		scripts = append(scripts, ref(id))
+		parts = append(parts, ref(id))
+	}
+	if workflowID == "" {
+		return fmt.Errorf("package error: the manifest lists no job script for %s", manifest.Job.Details.Name)
+	}
+	workflow["@type"] = []string{"File", "SoftwareSourceCode", "ComputationalWorkflow"}
+	workflow["name"] = manifest.Job.Details.Name
+	workflow["programmingLanguage"] = ref("#bash")
+	workflow["input"] = inputs
+	workflow["hasPart"] = scripts
+	workflow["step"] = steps
+	graph = append(graph, workflow, crateEntity{
+		"@id":   "#bash",
+		"@type": "ComputerLanguage",
+		"name":  "Bash",
+	}, crateEntity{
+		"@id":     "#commander",
+		"@type":   "SoftwareApplication",
+		"name":    "commander",
+		"version": manifest.CommanderVersion,
+	})
+	parts = append(parts, ref(workflowID))
+
+	// The crate root and the metadata descriptor.
+	experiment := manifest.Job.ExperimentDetails
+	root := crateEntity{
+		"@id":           "./",
+		"@type":         "Dataset",
+		"name":          fmt.Sprintf("%s analysis %s", experiment.Name, manifest.AnalysisID),
+		"description":   fmt.Sprintf("Analysis %s of experiment %s (PI %s) generated by commander on %s", manifest.AnalysisID, experiment.Name, experiment.PI, manifest.Host),
+		"datePublished": time.Now().Format(time.RFC3339),
+		"dateCreated":   manifest.GeneratedAt,
+		"mainEntity":    ref(workflowID),
+		"hasPart":       parts,
+		"mentions":      ref("#commander"),
+	}
+	descriptor := crateEntity{
+		"@id":        RO_CRATE_METADATA_FILE,
+		"@type":      "CreativeWork",
+		"conformsTo": ref(RO_CRATE_SPEC),
+		"about":      ref("./"),
+	}
+	graph = append([]crateEntity{descriptor, root}, graph...)
+
+	crate, err := json.MarshalIndent(map[string]interface{}{
+		"@context": RO_CRATE_CONTEXT,
+		"@graph":   graph,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFile(filepath.Join(analysisPath, RO_CRATE_METADATA_FILE), crate)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Done.")
+	return nil
+}
+
+func ref(id string) map[string]string {
+	return map[string]string{"@id": id}
+}
+
+/* ---
+ * Return the crate ID of a file. Files inside the analysis directory get a
+ * relative path. Files outside of it are referenced by file:// URI.
+ * --- */
+func crateID(analysisPath, path string) string {
+	if pathWithinDir(path, analysisPath) {
+		rel, err := filepath.Rel(analysisPath, path)
+		if err == nil {
+			return rel
+		}
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	return fmt.Sprintf("file://%s", abs)
+}
+
+func pathWithinDir(path, dir string) bool {
+	path = filepath.Clean(path)
+	dir = filepath.Clean(dir)
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+/* ---
+ * Return the Workflow Run RO-Crate term for a container runtime.
+ * --- */
+func containerImageType(runtime string) string {
+	switch runtime {
+	case datamodels.RUNTIME_DOCKER, datamodels.RUNTIME_PODMAN:
+		return "https://w3id.org/ro/terms/workflow-run#DockerImage"
+	}
+	return "https://w3id.org/ro/terms/workflow-run#SIFImage"
+}
+
+func encodingFormat(name string) string {
+	if filepath.Ext(name) == ".json" {
+		return "application/json"
+	}
+	return "text/plain"
+}
@@ -1,91 +1,158 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"strings"
 
 	"commander/datamodels"
 )
 
+// Container images resolved by the last preflight run.
+var resolvedImages = make([]datamodels.ResolvedImage, 0)
+
 /* -----------------------------------------------------------------------------
- * Main preflight test routine.
+ * Main preflight test routine. Every check runs, even after a failure, so a
+ * single run shows every problem. The results are summarised in a table and
+ * optionally written as JSON or JUnit.
  * -------------------------------------------------------------------------- */
 func PreflightTests(job datamodels.Job) error {
-	var err error
-	experiment := job.ExperimentDetails
+	fmt.Print("Performing pipeline preflight checks...\n\n")
 
-	// Test sample file directory
-	fmt.Println("Performing pipeline preflight checks...\n")
-	err = testSampleDirectory(experiment)
-	if err != nil {
-		fmt.Printf("WARNING: %s\n", err.Error())
-	}
+	report := runPreflightChecks(job, preflightChecks(job))
+	printPreflightSummary(report)
 
-	// Test existence of sample files.
-	if len(experiment.Samples) > 0 {
-		fmt.Println("Checking existence of sample files... \n")
-		err = testSampleFiles(experiment)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Test analysis directory
-	fmt.Printf("Checking existence of analysis directory %s... \n\n", experiment.PrintAnalysisPath())
-	err = testAnalysisDirectory(experiment)
+	err := writePreflightReports(report)
 	if err != nil {
 		return err
 	}
 
-	// Test working directory
-	if experiment.WorkDir != "" {
-		fmt.Printf("Checking existence of working directory %s... \n\n", experiment.PrintAnalysisPath())
-		err = testAnalysisDirectory(experiment)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Test tool directories
-	fmt.Println("Checking the existence of pipeline tool directories...\n")
-	for _, cmd := range job.Commands {
-		// Check for the existence of the tool output directory
-		err := testToolOutputDirectory(experiment, cmd.CommandParams.Command)
-		if err != nil {
-			return err
-		}
-	}
-
-	if len(job.CleanupActions) > 0 {
-		fmt.Println("Checking the existence of cleanup action destination paths...\n")
-		for _, a := range job.CleanupActions {
-			baseDir := job.ExperimentDetails.PrintAnalysisPath()
-			sourcePath := fmt.Sprintf("%s/%s", baseDir, a.ToolName)
-			destPath := fmt.Sprintf("%s/%s", baseDir, a.Destination)
-			err = testCleanupPaths(a.Action, sourcePath, destPath)
-			if err != nil {
-				return err
-			}
-		}
-
-	}
-
-	fmt.Println("Checking the existence of configuration archive directories...\n")
-	// Test configuration archive directory.
-	err = testArchiveDirectory(experiment)
-	if err != nil {
-		return err
+	if report.Status == datamodels.CHECK_FAIL {
+		return fmt.Errorf("Preflight failed. %d of %d checks failed.", report.Count(datamodels.CHECK_FAIL), len(report.Checks))
 	}
+	return nil
+}
 
-	// Test logging directory.
-	err = testLoggingDirectory(experiment)
-	if err != nil {
-		return err
+/* ---
+ * The preflight checks in the order they run. Checks that create directories
+ * come before the checks that rely on them.
+ * --- */
+func preflightChecks(job datamodels.Job) []preflightCheck {
+	experiment := job.ExperimentDetails
+	hasSamples := len(experiment.Samples) > 0
+
+	return []preflightCheck{
+		{
+			Name:    "sample_directory",
+			Message: "Checking existence of sample directory...",
+			Run: func() error {
+				// The samples may live elsewhere, so only warn.
+				if err := testSampleDirectory(experiment); err != nil {
+					preflightWarning("%s", err.Error())
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "sample_files",
+			Message: "Checking existence of sample files...",
+			Skip:    !hasSamples,
+			Run:     func() error { return testSampleFiles(experiment) },
+		},
+		{
+			Name:    "fastq_content",
+			Message: fmt.Sprintf("Checking sample file content (%s)...", FastqCheck),
+			Skip:    !hasSamples || FastqCheck == FASTQ_CHECK_OFF,
+			Run:     func() error { return testSampleFastqs(experiment) },
+		},
+		{
+			Name:    "sample_checksums",
+			Message: "Verifying sample file checksums...",
+			Skip:    !hasSamples || !VerifyChecksums,
+			Run:     func() error { return testSampleChecksums(experiment) },
+		},
+		{
+			Name:    "analysis_directory",
+			Message: fmt.Sprintf("Checking existence of analysis directory %s...", experiment.PrintAnalysisPath()),
+			Run:     func() error { return testAnalysisDirectory(experiment) },
+		},
+		{
+			Name:    "existing_outputs",
+			Message: "Checking for existing analysis output...",
+			Run:     func() error { return testExistingOutputs(job) },
+		},
+		{
+			Name:    "working_directory",
+			Message: fmt.Sprintf("Checking existence of working directory %s...", experiment.PrintWorkingDirectory()),
+			Skip:    experiment.WorkDir == "",
+			Run:     func() error { return testWorkingDirectory(experiment) },
+		},
+		{
+			Name:    "tool_directories",
+			Message: "Checking the existence of pipeline tool directories...",
+			Run: func() error {
+				for _, cmd := range job.Commands {
+					if err := testToolOutputDirectory(experiment, cmd.StepID()); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "cleanup_paths",
+			Message: "Checking the existence of cleanup action destination paths...",
+			Skip:    len(job.CleanupActions) == 0,
+			Run: func() error {
+				for _, a := range job.CleanupActions {
+					baseDir := experiment.PrintAnalysisPath()
+					sourcePath := fmt.Sprintf("%s/%s", baseDir, a.Step)
+					destPath := fmt.Sprintf("%s/%s", baseDir, a.Destination)
+					if err := testCleanupPaths(a.Action, sourcePath, destPath); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "disk_space",
+			Message: "Estimating disk space and inodes...",
+			Run:     func() error { return testDiskSpace(job) },
+		},
+		{
+			Name:    "cluster_limits",
+			Message: "Checking step resources against the cluster...",
+			Skip:    job.ClusterFile == "" || Platform != "slurm",
+			Run:     func() error { return testClusterLimits(job) },
+		},
+		{
+			Name:    "reference_indexes",
+			Message: "Checking reference indexes...",
+			Run:     func() error { return testReferenceIndexes(job) },
+		},
+		{
+			Name:    "container_images",
+			Message: "Checking container images...",
+			Run:     func() error { return testContainerImages(job) },
+		},
+		{
+			Name:    "archive_directory",
+			Message: "Checking the existence of configuration archive directories...",
+			Run:     func() error { return testArchiveDirectory(experiment) },
+		},
+		{
+			Name:    "logging_directory",
+			Message: "Checking the existence of the logging directory...",
+			Run:     func() error { return testLoggingDirectory(experiment) },
+		},
 	}
-	return nil
 }
 
 /* -----------------------------------------------------------------------------
@@ -111,7 +178,7 @@ func ArchiveParamFile(paramFile string, experiment datamodels.Experiment) (int64
 	}
 	defer paramFileSrc.Close()
 
-	paramFileDst, err := os.Create(paramDstPath)
+	paramFileDst, err := createFile(paramDstPath)
 	if err != nil {
 		return 0, err
 	}
@@ -146,7 +213,7 @@ func ArchiveDesignFile(experiment datamodels.Experiment) (int64, error) {
 	}
 	defer designFileSrc.Close()
 
-	designFileDst, err := os.Create(designDstPath)
+	designFileDst, err := createFile(designDstPath)
 	if err != nil {
 		return 0, err
 	}
@@ -160,6 +227,24 @@ func ArchiveDesignFile(experiment datamodels.Experiment) (int64, error) {
 	return nBytes, nil
 }
 
+/* ---
+ * Record the images resolved during preflight next to the archived config.
+ * --- */
+func ArchiveResolvedImages(experiment datamodels.Experiment) error {
+	fmt.Printf("Archiving resolved container images... \n")
+	imagesDstPath := fmt.Sprintf("%s/config/images.json", experiment.PrintAnalysisPath())
+	content, err := json.MarshalIndent(resolvedImages, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFile(imagesDstPath, content)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done.\n\n")
+	return nil
+}
+
 /* -----------------------------------------------------------------------------
  * Local test helpers.
  * -------------------------------------------------------------------------- */
@@ -216,7 +301,7 @@ func testSampleFiles(experiment datamodels.Experiment) error {
 
 	if len(notfound) > 0 {
 		// Echo the files that were not found
-		fmt.Println("The following sample files could not be found...\n")
+		fmt.Print("The following sample files could not be found...\n\n")
 		for _, f := range notfound {
 			fmt.Println(f)
 		}
@@ -240,14 +325,14 @@ func testAnalysisDirectory(experiment datamodels.Experiment) error {
 		// the directory.
 		fmt.Printf("Directory %s does not exist.\n", experiment.PrintAnalysisPath())
 		fmt.Printf("Creating directory...\n\n")
-		err = os.MkdirAll(experiment.PrintAnalysisPath(), 0755)
+		err = makeDir(experiment.PrintAnalysisPath())
 		if err != nil {
 			return err
 		}
 	} else if err != nil {
 		return err
 	} else {
-		fmt.Println("Directory exists.\n")
+		fmt.Print("Directory exists.\n\n")
 	}
 	return nil
 }
@@ -263,14 +348,14 @@ func testWorkingDirectory(experiment datamodels.Experiment) error {
 		// the directory.
 		fmt.Printf("Directory %s does not exist.\n", experiment.PrintWorkingDirectory())
 		fmt.Printf("Creating directory...\n\n")
-		err = os.MkdirAll(experiment.PrintWorkingDirectory(), 0755)
+		err = makeDir(experiment.PrintWorkingDirectory())
 		if err != nil {
 			return err
 		}
 	} else if err != nil {
 		return err
 	} else {
-		fmt.Println("Directory exists.\n")
+		fmt.Print("Directory exists.\n\n")
 	}
 	return nil
 }
@@ -287,7 +372,7 @@ func testToolOutputDirectory(experiment datamodels.Experiment, tool string) erro
 		// The directory does not exist. Try to create it on user's behalf.
 		fmt.Printf("Directory %s does not exist.\n", path)
 		fmt.Printf("Creating directory...\n\n")
-		err = os.MkdirAll(path, 0755)
+		err = makeDir(path)
 		if err != nil {
 			return err
 		}
@@ -330,7 +415,7 @@ func testCleanupPaths(action, sourcePath, destPath string) error {
 		// the directory.
 		fmt.Printf("Source directory for cleanup action '%s' does not exist.\n", cleanupAction)
 		fmt.Printf("Creating directory... \n\n")
-		err = os.MkdirAll(sourcePath, 0755)
+		err = makeDir(sourcePath)
 		if err != nil {
 			return err
 		}
@@ -342,7 +427,7 @@ func testCleanupPaths(action, sourcePath, destPath string) error {
 		// the directory.
 		fmt.Printf("Destination directory for cleanup action '%s' does not exist.\n", cleanupAction)
 		fmt.Printf("Creating directory... \n\n")
-		err = os.MkdirAll(destPath, 0755)
+		err = makeDir(destPath)
 		if err != nil {
 			return err
 		}
@@ -364,7 +449,7 @@ func testArchiveDirectory(experiment datamodels.Experiment) error {
 		// the directory.
 		fmt.Printf("Archive directory %s does not exist.\n", archivePath)
 		fmt.Printf("Creating directory... \n")
-		err = os.MkdirAll(archivePath, 0755)
+		err = makeDir(archivePath)
 		if err != nil {
 			return err
 		}
@@ -390,7 +475,7 @@ func testLoggingDirectory(experiment datamodels.Experiment) error {
 		// the directory.
 		msgBuffer = append(msgBuffer, fmt.Sprintf("Logging directory %s does not exist.\n", logPath))
 		msgBuffer = append(msgBuffer, fmt.Sprintf("Creating directory... "))
-		err = os.MkdirAll(logPath, 0755)
+		err = makeDir(logPath)
 		if err != nil {
 			return err
 		}
@@ -403,11 +488,156 @@ func testLoggingDirectory(experiment datamodels.Experiment) error {
 	return nil
 }
 
+/* ---
+ * Check the files that make up every reference index a command uses.
+ * --- */
+func testReferenceIndexes(job datamodels.Job) error {
+	var missing = make([]string, 0)
+
+	for _, cmd := range job.Commands {
+		adapter, ok := datamodels.AdapterFor(cmd)
+		if !ok || cmd.IndexPath == "" {
+			continue
+		}
+		// Any complete set of index files will do. Report what the regular
+		// index is missing.
+		var setMissing []string
+		for n, set := range adapter.IndexFileSets(cmd.IndexPath) {
+			var absent = make([]string, 0)
+			for _, f := range set {
+				if _, err := os.Stat(f); err != nil {
+					absent = append(absent, f)
+				}
+			}
+			if len(absent) == 0 {
+				setMissing = nil
+				break
+			}
+			if n == 0 {
+				setMissing = absent
+			}
+		}
+		for _, f := range setMissing {
+			missing = append(missing, fmt.Sprintf("%s (step %s, reference %s)", f, cmd.StepID(), cmd.ReferenceName))
+		}
+	}
+
+	if len(missing) > 0 {
+		fmt.Print("The following reference index files could not be found...\n\n")
+		for _, f := range missing {
+			fmt.Println(f)
+		}
+		fmt.Println()
+		return errors.New("Missing reference index files. Please check the reference registry.")
+	}
+	return nil
+}
+
+/* ---
+ * Verify the container image of every command. Local images are hashed and
+ * checked against any pinned sha256. Image URIs are pulled into the image
+ * directory when one is configured. Images that are not pinned produce a
+ * warning. The resolved images are kept for archiving.
+ * --- */
+func testContainerImages(job datamodels.Job) error {
+	resolvedImages = make([]datamodels.ResolvedImage, 0)
+
+	for _, cmd := range job.Commands {
+		params := cmd.CommandParams
+		if !params.UsesContainer() {
+			continue
+		}
+
+		resolved := datamodels.ResolvedImage{
+			Step:      cmd.StepID(),
+			Runtime:   params.ContainerRuntime(),
+			Reference: params.SourceImage(),
+			Digest:    params.ImageDigest(),
+		}
+		singularity := resolved.Runtime == datamodels.RUNTIME_SINGULARITY || resolved.Runtime == datamodels.RUNTIME_APPTAINER
+
+		if params.IsImageURI() && singularity && params.Container.ImageDir != "" {
+			// Pull the image into the image directory unless it is cached already.
+			resolved.Path = params.CachedImagePath()
+			if _, err := os.Stat(resolved.Path); os.IsNotExist(err) && DryRun {
+				fmt.Printf("[dry-run] Would run %s pull %s %s\n", resolved.Runtime, resolved.Path, resolved.Reference)
+				resolvedImages = append(resolvedImages, resolved)
+				continue
+			} else if os.IsNotExist(err) {
+				fmt.Printf("Pulling image %s into %s...\n", resolved.Reference, resolved.Path)
+				if err = makeDir(params.Container.ImageDir); err != nil {
+					return err
+				}
+				out, err := exec.Command(resolved.Runtime, "pull", resolved.Path, resolved.Reference).CombinedOutput()
+				if err != nil {
+					return fmt.Errorf("Image error. Could not pull %s for step %s: %s\n%s", resolved.Reference, resolved.Step, err.Error(), out)
+				}
+			}
+		} else if !params.IsImageURI() && singularity {
+			resolved.Path = params.SourceImage()
+		}
+
+		if resolved.Path != "" {
+			// Hash the local image and compare it against the pin.
+			hash, err := sha256File(resolved.Path)
+			if err != nil && params.Container.SHA256 != "" {
+				return fmt.Errorf("Image error. Could not read pinned image %s for step %s: %s", resolved.Path, resolved.Step, err.Error())
+			} else if err != nil {
+				// The path may only resolve on the compute nodes, e.g. through
+				// a variable set in the misc preamble.
+				preflightWarning("Could not read image %s for step %s. Skipping verification.", resolved.Path, resolved.Step)
+				resolvedImages = append(resolvedImages, resolved)
+				continue
+			}
+			if params.Container.SHA256 != "" && params.Container.SHA256 != hash {
+				return fmt.Errorf("Image error. Image %s for step %s has sha256 %s but %s is pinned", resolved.Path, resolved.Step, hash, params.Container.SHA256)
+			}
+			if params.Container.SHA256 == "" && !strings.Contains(resolved.Reference, "@") {
+				preflightWarning("Image %s for step %s is not pinned. Its sha256 is %s.", resolved.Path, resolved.Step, hash)
+			}
+			if resolved.Digest == "" || params.Container.SHA256 != "" {
+				resolved.Digest = fmt.Sprintf("sha256:%s", hash)
+			}
+		} else if params.Container.SHA256 != "" {
+			// The image is only pulled on the compute nodes, so there is no
+			// file to hash and the pin can't be enforced.
+			return fmt.Errorf("Image error. Image %s for step %s is pinned by sha256 but is never pulled during preflight, so the pin can't be verified. Set image_dir so the image is pulled and hashed, or pin the reference by digest (name@sha256:...) instead", resolved.Reference, resolved.Step)
+		} else if resolved.Digest == "" {
+			preflightWarning("Image %s for step %s is not pinned by digest.", resolved.Reference, resolved.Step)
+		}
+
+		resolvedImages = append(resolvedImages, resolved)
+	}
+	fmt.Println()
+	return nil
+}
+
+/* ---
+ * Return the hex encoded sha256 of a file.
+ * --- */
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 /* ---
  * Create a test file in an output path.
  * This is used to test permissions on an output directory.
  * --- */
 func createTestFile(path string) error {
+	if DryRun {
+		// Leave the directory untouched.
+		return nil
+	}
 	testfile := fmt.Sprintf("%s/test.txt", path)
 	// Use os.Create to create a file for writing.
 	_, err := os.Create(testfile)
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Set from the --preflight-json and --preflight-junit command line flags.
+var PreflightJSON string
+var PreflightJUnit string
+
+// A named preflight check. Checks that do not apply to the job, or were not
+// asked for, are reported as skipped.
+type preflightCheck struct {
+	Name    string
+	Message string
+	Skip    bool
+	Run     func() error
+}
+
+// Warnings raised by the check that is running.
+var checkWarnings = make([]string, 0)
+
+/* -----------------------------------------------------------------------------
+ * Running preflight checks and reporting their results.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Print a warning and record it against the running check.
+ * --- */
+func preflightWarning(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	fmt.Printf("WARNING: %s\n", msg)
+	checkWarnings = append(checkWarnings, msg)
+}
+
+/* ---
+ * Run every check, collecting its outcome. A check fails when it returns an
+ * error and warns when it raised any warning.
+ * --- */
+func runPreflightChecks(job datamodels.Job, checks []preflightCheck) datamodels.PreflightReport {
+	report := datamodels.PreflightReport{
+		AnalysisPath: job.ExperimentDetails.PrintAnalysisPath(),
+		GeneratedAt:  time.Now().Format(time.RFC3339),
+		Status:       datamodels.CHECK_PASS,
+		Checks:       make([]datamodels.CheckResult, 0),
+	}
+
+	for _, check := range checks {
+		result := datamodels.CheckResult{Name: check.Name}
+		if check.Skip {
+			result.Status = datamodels.CHECK_SKIP
+			report.Checks = append(report.Checks, result)
+			continue
+		}
+
+		fmt.Printf("%s\n\n", check.Message)
+		checkWarnings = make([]string, 0)
+		start := time.Now()
+		err := check.Run()
+		result.Duration = time.Since(start).Seconds()
+
+		if err != nil {
+			fmt.Printf("FAIL: %s\n\n", err.Error())
+			result.Status = datamodels.CHECK_FAIL
+			result.Details = append([]string{err.Error()}, checkWarnings...)
+			report.Status = datamodels.CHECK_FAIL
+		} else if len(checkWarnings) > 0 {
+			result.Status = datamodels.CHECK_WARN
+			result.Details = checkWarnings
+			if report.Status == datamodels.CHECK_PASS {
+				report.Status = datamodels.CHECK_WARN
+			}
+		} else {
+			result.Status = datamodels.CHECK_PASS
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+/* ---
+ * Print a table of every check and its outcome.
+ * --- */
+func printPreflightSummary(report datamodels.PreflightReport) {
+	fmt.Print("Preflight summary:\n\n")
+	fmt.Printf("%-20s %-6s %s\n", "check", "status", "details")
+	for _, c := range report.Checks {
+		var details = ""
+		if len(c.Details) > 0 {
+			details = c.Details[0]
+			if len(c.Details) > 1 {
+				details = fmt.Sprintf("%s (+%d more)", details, len(c.Details)-1)
+			}
+		}
+		fmt.Printf("%-20s %-6s %s\n", c.Name, strings.ToUpper(c.Status), details)
+	}
+	fmt.Printf(
+		"\n%d passed, %d warnings, %d failed, %d skipped.\n\n",
+		report.Count(datamodels.CHECK_PASS),
+		report.Count(datamodels.CHECK_WARN),
+		report.Count(datamodels.CHECK_FAIL),
+		report.Count(datamodels.CHECK_SKIP),
+	)
+}
+
+/* ---
+ * Write the report in the formats asked for. In dry-run mode the reports are
+ * only printed, like every other file.
+ * --- */
+func writePreflightReports(report datamodels.PreflightReport) error {
+	if PreflightJSON != "" {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = writeFile(PreflightJSON, content); err != nil {
+			return err
+		}
+		if !DryRun {
+			fmt.Printf("Wrote preflight report to %s\n", PreflightJSON)
+		}
+	}
+
+	if PreflightJUnit != "" {
+		content, err := junitReport(report)
+		if err != nil {
+			return err
+		}
+		if err = writeFile(PreflightJUnit, content); err != nil {
+			return err
+		}
+		if !DryRun {
+			fmt.Printf("Wrote preflight JUnit report to %s\n", PreflightJUnit)
+		}
+	}
+	return nil
+}
+
+/* ---
+ * JUnit XML layout understood by most CI systems. Every check is a test case.
+ * Warnings are kept as system output so they don't fail the build.
+ * --- */
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      float64     `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func junitReport(report datamodels.PreflightReport) ([]byte, error) {
+	suite := junitSuite{
+		Name:      fmt.Sprintf("commander preflight %s", report.AnalysisPath),
+		Tests:     len(report.Checks),
+		Failures:  report.Count(datamodels.CHECK_FAIL),
+		Skipped:   report.Count(datamodels.CHECK_SKIP),
+		Timestamp: report.GeneratedAt,
+		Cases:     make([]junitCase, 0),
+	}
+
+	for _, c := range report.Checks {
+		tc := junitCase{Name: c.Name, ClassName: "commander.preflight", Time: c.Duration}
+		suite.Time += c.Duration
+		switch c.Status {
+		case datamodels.CHECK_FAIL:
+			tc.Failure = &junitFailure{Message: c.Details[0], Body: strings.Join(c.Details, "\n")}
+		case datamodels.CHECK_SKIP:
+			tc.Skipped = &struct{}{}
+		case datamodels.CHECK_WARN:
+			tc.SystemOut = strings.Join(c.Details, "\n")
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	content, err := xml.MarshalIndent(junitSuites{Suites: []junitSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), content...), nil
+}
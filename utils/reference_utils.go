@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Jeffail/gabs"
+)
+
+/* -----------------------------------------------------------------------------
+ * Functions for parsing the reference registry.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Parse a reference registry file. The registry maps a genome name to its
+ * FASTA, GTF and per-tool index locations, e.g.
+ * {
+ *   "gryllus_bimaculatus": {
+ *     "fasta": "/compbio/references/gbim/genome.fa",
+ *     "gtf": "/compbio/references/gbim/genes.gtf",
+ *     "indexes": {"star": "/compbio/references/gbim/STAR", "hisat2": "/compbio/references/gbim/HISAT2/gbim"}
+ *   }
+ * }
+ * --- */
+func ParseReferenceRegistry(filename string) (map[string]datamodels.Reference, error) {
+	var registry = make(map[string]datamodels.Reference)
+
+	rawJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return registry, err
+	}
+
+	jsonParsed, err := gabs.ParseJSON(rawJSON)
+	if err != nil {
+		return registry, err
+	}
+
+	for name, c := range jsonParsed.ChildrenMap() {
+		reference := datamodels.Reference{Name: name, Indexes: make(map[string]string)}
+		if c.Exists("fasta") {
+			reference.FASTA = c.Path("fasta").Data().(string)
+		}
+		if c.Exists("gtf") {
+			reference.GTF = c.Path("gtf").Data().(string)
+		}
+		for tool, index := range c.Path("indexes").ChildrenMap() {
+			reference.Indexes[tool] = index.Data().(string)
+		}
+		registry[name] = reference
+	}
+	return registry, nil
+}
+
+/* ---
+ * Resolve the reference of every command that names one against the registry
+ * and pick the index for the command's tool.
+ * --- */
+func resolveReferences(job *datamodels.Job, registryFile string) error {
+	var registry map[string]datamodels.Reference
+	var err error
+
+	for i := range job.Commands {
+		cmd := &job.Commands[i]
+		if cmd.ReferenceName == "" {
+			continue
+		}
+
+		// Only load the registry once it is needed.
+		if registry == nil {
+			if registryFile == "" {
+				return fmt.Errorf(`JSON error: step "%s" names reference "%s" but no "reference_registry" is given`, cmd.StepID(), cmd.ReferenceName)
+			}
+			registry, err = ParseReferenceRegistry(registryFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		reference, ok := registry[cmd.ReferenceName]
+		if !ok {
+			return fmt.Errorf(`reference error: reference "%s" for step "%s" is not in registry %s`, cmd.ReferenceName, cmd.StepID(), registryFile)
+		}
+		cmd.Reference = reference
+
+		adapter, ok := datamodels.AdapterFor(*cmd)
+		if !ok || adapter.IndexName == "" {
+			return fmt.Errorf(`reference error: commander does not know how to pass a reference to %s (step "%s")`, cmd.CommandName(), cmd.StepID())
+		}
+		index, ok := reference.Indexes[adapter.IndexName]
+		if !ok {
+			return fmt.Errorf(`reference error: reference "%s" has no %s index for step "%s"`, cmd.ReferenceName, adapter.IndexName, cmd.StepID())
+		}
+		cmd.IndexPath = index
+	}
+	return nil
+}
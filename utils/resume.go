@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Set from the --resume and --force-step command line flags.
+var Resume bool
+var ForceSteps []string
+
+// Steps (and samples of batch steps) found complete by PlanResume.
+var completedSteps = make(map[resumeKey]bool)
+
+type resumeKey struct {
+	Step   string
+	Sample string
+}
+
+/* -----------------------------------------------------------------------------
+ * Decide which steps can be skipped when resuming a pipeline.
+ * -------------------------------------------------------------------------- */
+func PlanResume(job datamodels.Job) error {
+	completedSteps = make(map[resumeKey]bool)
+	if !Resume {
+		return nil
+	}
+
+	dag, err := job.BuildDAG()
+	if err != nil {
+		return err
+	}
+
+	forced, err := forcedSteps(dag)
+	if err != nil {
+		return err
+	}
+
+	levels, err := dag.Levels()
+	if err != nil {
+		return err
+	}
+
+	// Walk the schedule in order so parents are decided before children.
+	fmt.Println("Checking for completed steps...")
+	for _, level := range levels {
+		for _, id := range level {
+			if forced[id] {
+				continue
+			}
+			cmd := job.Commands[dag.Index[id]]
+			if cmd.Batch {
+				for _, sample := range job.ExperimentDetails.Samples {
+					if stepComplete(cmd, &sample, job, dag) {
+						completedSteps[resumeKey{id, sample.Prefix}] = true
+					}
+				}
+			} else if stepComplete(cmd, nil, job, dag) {
+				completedSteps[resumeKey{id, ""}] = true
+			}
+		}
+	}
+	return nil
+}
+
+/* ---
+ * Check if a step (or a sample of a batch step) should be written to the job
+ * script. Skipped steps are recorded in the generation summary.
+ * --- */
+func shouldRunStep(cmd datamodels.Command, sample *datamodels.Sample) bool {
+	var key = resumeKey{cmd.StepID(), ""}
+	if sample != nil {
+		key.Sample = sample.Prefix
+	}
+
+	if reason, ok := excludedSteps[key]; ok {
+		recordSkip(cmd, sample, reason)
+		return false
+	}
+	if completedSteps[key] {
+		recordSkip(cmd, sample, "already completed")
+		return false
+	}
+	return true
+}
+
+/* ---
+ * Collect the forced steps together with every step downstream of them.
+ * --- */
+func forcedSteps(dag datamodels.StepDAG) (map[string]bool, error) {
+	var forced = make(map[string]bool)
+	var queue = make([]string, 0)
+
+	for _, id := range ForceSteps {
+		if _, ok := dag.Index[id]; !ok {
+			return forced, fmt.Errorf(`resume error: unknown step "%s" passed to --force-step`, id)
+		}
+		queue = append(queue, id)
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if forced[id] {
+			continue
+		}
+		forced[id] = true
+		queue = append(queue, dag.Children[id]...)
+	}
+	return forced, nil
+}
+
+/* ---
+ * A step is complete when its sentinel exists, every step it takes input from
+ * is complete and none of its inputs changed after the sentinel was written.
+ * --- */
+func stepComplete(cmd datamodels.Command, sample *datamodels.Sample, job datamodels.Job, dag datamodels.StepDAG) bool {
+	sentinel, err := os.Stat(cmd.SentinelPath(sample))
+	if err != nil {
+		return false
+	}
+
+	var inputs = make([]string, 0)
+	if len(dag.Parents[cmd.StepID()]) == 0 && sample != nil {
+		// The step reads the raw sample files.
+		inputs = append(inputs, sample.DumpForwardReadFileWithPath())
+		if sample.IsPairedEnd() {
+			inputs = append(inputs, sample.DumpReverseReadFileWithPath())
+		}
+	}
+
+	for _, parentID := range dag.Parents[cmd.StepID()] {
+		parent := job.Commands[dag.Index[parentID]]
+		if !parent.Batch {
+			if !completedSteps[resumeKey{parentID, ""}] {
+				return false
+			}
+			inputs = append(inputs, parent.SentinelPath(nil))
+		} else if sample != nil {
+			if !completedSteps[resumeKey{parentID, sample.Prefix}] {
+				return false
+			}
+			inputs = append(inputs, parent.SentinelPath(sample))
+		} else {
+			// A non-batch step downstream of a batch step needs every sample.
+			for _, s := range job.ExperimentDetails.Samples {
+				if _, ok := excludedSteps[resumeKey{parentID, s.Prefix}]; ok {
+					continue
+				}
+				if !completedSteps[resumeKey{parentID, s.Prefix}] {
+					return false
+				}
+				inputs = append(inputs, parent.SentinelPath(&s))
+			}
+		}
+	}
+
+	return !anyModifiedAfter(inputs, sentinel.ModTime())
+}
+
+/* ---
+ * Check if any of the files is missing or was modified after the given time.
+ * --- */
+func anyModifiedAfter(paths []string, t time.Time) bool {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil || info.ModTime().After(t) {
+			return true
+		}
+	}
+	return false
+}
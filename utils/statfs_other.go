@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package utils
+
+import "os"
+
+/* ---
+ * Free space cannot be queried on this platform, so the disk space check is
+ * skipped.
+ * --- */
+func filesystemFree(path string) (uint64, uint64, bool) {
+	return 0, 0, false
+}
+
+func filesystemDevice(path string) (uint64, bool) {
+	return 0, false
+}
+
+func fileIdentity(info os.FileInfo) (uint64, uint64, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+/* ---
+ * Return the bytes and inodes available to the user on the filesystem
+ * holding a path.
+ * --- */
+func filesystemFree(path string) (uint64, uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, false
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Ffree), true
+}
+
+/* ---
+ * Return the device of the filesystem holding a path.
+ * --- */
+func filesystemDevice(path string) (uint64, bool) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
+
+/* ---
+ * Return the device and inode of a file.
+ * --- */
+func fileIdentity(info os.FileInfo) (uint64, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
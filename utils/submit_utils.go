@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Characters that can't appear in a shell variable name.
+var shellUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+/* -----------------------------------------------------------------------------
+ * Writing a pipeline as separate Slurm jobs.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Write a submit script that submits every step, and every sample of a batch
+ * step, as its own Slurm job. Each job waits on the jobs of the steps it takes
+ * input from. Batch steps only wait on the same sample of a batch input step,
+ * so samples move through the pipeline independently. There is no job script
+ * around the steps, so each step script carries the misc preamble itself.
+ * --- */
+func writeSeparateSlurmJobs(job datamodels.Job, experiment datamodels.Experiment) error {
+	fmt.Println("Writing separate job submit script...")
+
+	dag, err := job.BuildDAG()
+	if err != nil {
+		return err
+	}
+	schedule, err := job.Schedule()
+	if err != nil {
+		return err
+	}
+
+	err = makeDir(OutDir)
+	if err != nil {
+		return err
+	}
+	filename := JobScriptPath(job)
+	submitFile, err := createFile(filename)
+	if err != nil {
+		return err
+	}
+	defer submitFile.Close()
+	if err = makeExecutable(filename); err != nil {
+		return err
+	}
+
+	logPath := fmt.Sprintf("%s/logs", experiment.PrintAnalysisPath())
+	fmt.Fprintln(submitFile, "#!/bin/bash")
+	fmt.Fprintln(submitFile, fmt.Sprintf("# Submits every step of %s as its own Slurm job. Run with bash, not sbatch.", job.Details.Name))
+	fmt.Fprintln(submitFile)
+	fmt.Fprintln(submitFile, fmt.Sprintf("mkdir -p %s", logPath))
+	fmt.Fprintln(submitFile)
+
+	// Shell variables holding the job IDs of every step, and of every sample
+	// of a batch step.
+	var stepJobs = make(map[string][]string)
+	var sampleJobs = make(map[string]string)
+
+	for _, level := range schedule {
+		for _, cmd := range level {
+			if !cmd.Batch {
+				if !shouldRunStep(cmd, nil) {
+					continue
+				}
+				script, err := writeCommandScript(cmd, job.MiscPreamble)
+				if err != nil {
+					return err
+				}
+				if err = makeExecutable(script); err != nil {
+					return err
+				}
+
+				deps := stepDependencies(cmd, nil, job, dag, stepJobs, sampleJobs)
+				jobVar := writeSbatchLine(submitFile, cmd.StepID(), cmd.Preamble, job.SlurmPreamble, logPath, deps, script)
+				stepJobs[cmd.StepID()] = append(stepJobs[cmd.StepID()], jobVar)
+				continue
+			}
+
+			for _, sample := range experiment.Samples {
+				if !shouldRunStep(cmd, &sample) {
+					continue
+				}
+				script, err := writeCommandScriptForSample(cmd, sample, job.MiscPreamble)
+				if err != nil {
+					return err
+				}
+				if err = makeExecutable(script); err != nil {
+					return err
+				}
+
+				name := fmt.Sprintf("%s_%s", cmd.StepID(), sample.Prefix)
+				deps := stepDependencies(cmd, &sample, job, dag, stepJobs, sampleJobs)
+				jobVar := writeSbatchLine(submitFile, name, cmd.Preamble, job.SlurmPreamble, logPath, deps, script)
+				stepJobs[cmd.StepID()] = append(stepJobs[cmd.StepID()], jobVar)
+				sampleJobs[sampleJobKey(cmd.StepID(), sample.Prefix)] = jobVar
+			}
+		}
+	}
+
+	// Clean up once every step job succeeded.
+	actions := job.FormatCleanupActions()
+	if len(actions) > 0 {
+		script := scriptPath(fmt.Sprintf("%s_cleanup.sh", job.Details.Name))
+		cleanupFile, err := createFile(script)
+		if err != nil {
+			return err
+		}
+		writeBashScriptHeader(cleanupFile)
+		writeStepMiscPreamble(cleanupFile, job.MiscPreamble)
+		writeCleanupActions(cleanupFile, actions)
+		if err = cleanupFile.Close(); err != nil {
+			return err
+		}
+		if err = makeExecutable(script); err != nil {
+			return err
+		}
+
+		var deps = make([]string, 0)
+		for _, id := range dag.Steps {
+			deps = append(deps, stepJobs[id]...)
+		}
+		cleanup := datamodels.CommandPreamble{Tasks: 1, CPUs: 1}
+		writeSbatchLine(submitFile, fmt.Sprintf("%s_cleanup", job.Details.Name), cleanup, job.SlurmPreamble, logPath, deps, script)
+	}
+	return nil
+}
+
+/* ---
+ * Return the shell variables of the jobs a step has to wait on. Steps skipped
+ * on resume have no job and are not waited on.
+ * --- */
+func stepDependencies(cmd datamodels.Command, sample *datamodels.Sample, job datamodels.Job, dag datamodels.StepDAG, stepJobs map[string][]string, sampleJobs map[string]string) []string {
+	var deps = make([]string, 0)
+	for _, parent := range dag.Parents[cmd.StepID()] {
+		parentCmd := job.Commands[dag.Index[parent]]
+		if sample != nil && parentCmd.Batch {
+			if jobVar, ok := sampleJobs[sampleJobKey(parent, sample.Prefix)]; ok {
+				deps = append(deps, jobVar)
+			}
+			continue
+		}
+		deps = append(deps, stepJobs[parent]...)
+	}
+	return deps
+}
+
+func sampleJobKey(stepID, prefix string) string {
+	return fmt.Sprintf("%s\t%s", stepID, prefix)
+}
+
+/* ---
+ * Write the sbatch line that submits a script as its own job and keeps the
+ * job ID in a shell variable. Settings the step leaves unset come from the
+ * job's slurm preamble. Returns the name of the variable.
+ * --- */
+func writeSbatchLine(submitFile io.Writer, name string, preamble datamodels.CommandPreamble, jobPreamble datamodels.SlurmPreamble, logPath string, deps []string, script string) string {
+	preamble = preamble.WithDefaults(jobPreamble)
+	jobVar := fmt.Sprintf("job_%s", shellUnsafe.ReplaceAllString(name, "_"))
+
+	var options = []string{
+		fmt.Sprintf(datamodels.STEP_OPTIONS["job_name"], name),
+		fmt.Sprintf(datamodels.STEP_OPTIONS["partition"], preamble.Partition),
+		fmt.Sprintf(datamodels.STEP_OPTIONS["time"], preamble.WallTime),
+		fmt.Sprintf(datamodels.STEP_OPTIONS["tasks"], preamble.Tasks),
+		fmt.Sprintf(datamodels.STEP_OPTIONS["cpus"], preamble.CPUs),
+	}
+	if preamble.Memory > 0 {
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["memory"], preamble.Memory))
+	}
+	if preamble.Account != "" {
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["account"], preamble.Account))
+	}
+	if preamble.QOS != "" {
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["qos"], preamble.QOS))
+	}
+	if preamble.Constraint != "" {
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["constraint"], preamble.Constraint))
+	}
+	if preamble.Exclusive {
+		options = append(options, datamodels.STEP_OPTIONS["exclusive"])
+	}
+	if notifications := jobPreamble.NotificationType(); notifications != "NONE" {
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["mail_type"], notifications))
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["mail_user"], jobPreamble.EmailAddress))
+	}
+	options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["output"], fmt.Sprintf("%s/%s_%%j.log", logPath, name)))
+	if len(deps) > 0 {
+		var ids = make([]string, 0)
+		for _, dep := range deps {
+			ids = append(ids, fmt.Sprintf("$%s", dep))
+		}
+		options = append(options, fmt.Sprintf(datamodels.STEP_OPTIONS["dependency"], strings.Join(ids, ":")))
+	}
+
+	fmt.Fprintln(submitFile, fmt.Sprintf("%s=$(sbatch --parsable %s %s) || exit 1", jobVar, strings.Join(options, " "), script))
+	fmt.Fprintln(submitFile, fmt.Sprintf(`echo "Submitted %s as job $%s"`, name, jobVar))
+	return jobVar
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"fmt"
+)
+
+// Decisions made while generating the job scripts.
+var generationSummary = make([]skipDecision, 0)
+
+type skipDecision struct {
+	Step   string
+	Sample string
+	Reason string
+}
+
+/* ---
+ * Record that a step (or a sample of a batch step) was left out of the job.
+ * --- */
+func recordSkip(cmd datamodels.Command, sample *datamodels.Sample, reason string) {
+	var decision = skipDecision{Step: cmd.StepID(), Reason: reason}
+	if sample != nil {
+		decision.Sample = sample.Prefix
+	}
+	generationSummary = append(generationSummary, decision)
+}
+
+/* -----------------------------------------------------------------------------
+ * Print the generation summary.
+ * -------------------------------------------------------------------------- */
+func PrintGenerationSummary() {
+	fmt.Println("Generation summary:")
+	if len(generationSummary) == 0 {
+		fmt.Printf("All steps were written for all samples.\n\n")
+		return
+	}
+	for _, d := range generationSummary {
+		if d.Sample != "" {
+			fmt.Printf("  SKIPPED %-24s sample %-16s %s\n", d.Step, d.Sample, d.Reason)
+		} else {
+			fmt.Printf("  SKIPPED %-24s %-23s %s\n", d.Step, "", d.Reason)
+		}
+	}
+	fmt.Println()
+}
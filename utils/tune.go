@@ -0,0 +1,291 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Jeffail/gabs"
+)
+
+// Headroom added on top of the most a step used in earlier runs.
+const (
+	TUNE_MEMORY_HEADROOM = 1.2
+	TUNE_TIME_HEADROOM   = 1.5
+)
+
+// Recommended memory and time are rounded up to these steps.
+const (
+	TUNE_MEMORY_STEP datamodels.Memory   = 256
+	TUNE_TIME_STEP   datamodels.WallTime = 15 * 60
+)
+
+/* -----------------------------------------------------------------------------
+ * Recommending step resources from earlier runs.
+ * -------------------------------------------------------------------------- */
+
+/* ---
+ * Recommend the CPUs, memory and time of every step of a param file from the
+ * accounting data in the logs directories of earlier analyses. Without
+ * analysis directories every analysis of the experiment is read. If writeFile
+ * is set, a copy of the param file with the recommendations is written to it.
+ * --- */
+func TuneAnalyses(paramFile string, analysisDirs []string, writeFile string) error {
+	var job datamodels.Job
+	var err error
+
+	if writeFile != "" && !IsJSONParam(paramFile) {
+		return errors.New("tune error: recommendations can only be written for JSON param files")
+	}
+	if writeFile != "" && filepath.Clean(writeFile) == filepath.Clean(paramFile) {
+		return errors.New("tune error: write the recommendations to a new param file, not to " + paramFile)
+	}
+
+	if IsJSONParam(paramFile) {
+		job, err = ParseJSONParams(paramFile)
+	} else {
+		job, err = ParsePlainTextParams(paramFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(analysisDirs) == 0 {
+		analysisDirs, err = experimentAnalyses(job.ExperimentDetails)
+		if err != nil {
+			return err
+		}
+	}
+
+	var records = make([]datamodels.UsageRecord, 0)
+	for _, dir := range analysisDirs {
+		found, err := ReadUsageDir(filepath.Join(dir, "logs"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		records = append(records, found...)
+	}
+	records = MatchUsageToSteps(records, job)
+	if len(records) == 0 {
+		return fmt.Errorf("tune error: no accounting data for the steps of %s found in the logs directory of %d analyses", job.Details.Name, len(analysisDirs))
+	}
+
+	var recommendations = make([]datamodels.Recommendation, 0)
+	for _, cmd := range job.Commands {
+		var runs = make([]datamodels.UsageRecord, 0)
+		for _, r := range records {
+			if r.Step == cmd.StepID() {
+				runs = append(runs, r)
+			}
+		}
+		if len(runs) > 0 {
+			recommendations = append(recommendations, RecommendResources(cmd.StepID(), runs, cmd.Preamble, !job.IsStandaloneCommand()))
+		}
+	}
+
+	fmt.Printf("Resource recommendations from %d runs in %d analyses:\n\n", len(records), len(analysisDirs))
+	WriteRecommendations(os.Stdout, recommendations, job)
+
+	if writeFile != "" {
+		err = writeTunedParams(paramFile, writeFile, recommendations, job)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nWrote the recommended resources to %s\n", writeFile)
+	}
+	return nil
+}
+
+/* ---
+ * Return the analysis directories of an experiment.
+ * --- */
+func experimentAnalyses(experiment datamodels.Experiment) ([]string, error) {
+	var dirs = make([]string, 0)
+	experimentPath := experiment.PrintExperimentPath()
+
+	entries, err := ioutil.ReadDir(experimentPath)
+	if err != nil {
+		return dirs, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, filepath.Join(experimentPath, entry.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+/* ---
+ * Set the step of every record its name belongs to and drop the records of
+ * other jobs. Names are the step ID, the step ID and a sample prefix, e.g.
+ * STAR_A, or the name of the script the step ran, e.g. STAR_A.sh. The longest
+ * matching step ID wins, so fastqc_trimmed is not taken for fastqc.
+ * --- */
+func MatchUsageToSteps(records []datamodels.UsageRecord, job datamodels.Job) []datamodels.UsageRecord {
+	var stepIDs = make([]string, 0)
+	for _, cmd := range job.Commands {
+		stepIDs = append(stepIDs, cmd.StepID())
+	}
+	sort.SliceStable(stepIDs, func(i, j int) bool {
+		return len(stepIDs[i]) > len(stepIDs[j])
+	})
+
+	var matched = make([]datamodels.UsageRecord, 0)
+	for _, r := range records {
+		name := strings.TrimSuffix(r.Name, ".sh")
+		for _, id := range stepIDs {
+			if name == id || strings.HasPrefix(name, id+"_") {
+				r.Step = id
+				matched = append(matched, r)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+/* ---
+ * Recommend the resources of a step from its runs. CPUs are the most the step
+ * kept busy on average. Memory is the peak use plus headroom, split over the
+ * CPUs if perCPU is set. Time is the longest run plus headroom. Values the runs
+ * say nothing about are kept from the current preamble.
+ * --- */
+func RecommendResources(stepID string, runs []datamodels.UsageRecord, current datamodels.CommandPreamble, perCPU bool) datamodels.Recommendation {
+	rec := datamodels.Recommendation{Step: stepID, Runs: len(runs)}
+
+	var usedCPUs, cpuSeconds, allocatedSeconds float64
+	for _, r := range runs {
+		usedCPUs = math.Max(usedCPUs, r.CPUsUsed())
+		if r.MaxRSS > rec.PeakMemory {
+			rec.PeakMemory = r.MaxRSS
+		}
+		rec.MaxElapsed = math.Max(rec.MaxElapsed, r.Elapsed)
+		if r.CPUs > 0 && r.Elapsed > 0 {
+			cpuSeconds += r.CPUSeconds
+			allocatedSeconds += float64(r.CPUs) * r.Elapsed
+		}
+	}
+	if allocatedSeconds > 0 {
+		rec.CPUEfficiency = cpuSeconds / allocatedSeconds
+	}
+
+	rec.CPUs = current.CPUs
+	if usedCPUs > 0 {
+		rec.CPUs = int64(math.Max(1, math.Ceil(usedCPUs)))
+	}
+
+	rec.Memory = current.Memory
+	if rec.PeakMemory > 0 {
+		memory := datamodels.Memory(math.Ceil(float64(rec.PeakMemory) * TUNE_MEMORY_HEADROOM))
+		if perCPU {
+			memory = memory.Per(rec.CPUs)
+		}
+		rec.Memory = roundUpMemory(memory)
+	}
+
+	rec.WallTime = current.WallTime
+	if rec.MaxElapsed > 0 {
+		rec.WallTime = roundUpWallTime(datamodels.WallTime(math.Ceil(rec.MaxElapsed * TUNE_TIME_HEADROOM)))
+	}
+	return rec
+}
+
+func roundUpMemory(m datamodels.Memory) datamodels.Memory {
+	return (m + TUNE_MEMORY_STEP - 1) / TUNE_MEMORY_STEP * TUNE_MEMORY_STEP
+}
+
+func roundUpWallTime(t datamodels.WallTime) datamodels.WallTime {
+	return (t + TUNE_TIME_STEP - 1) / TUNE_TIME_STEP * TUNE_TIME_STEP
+}
+
+/* ---
+ * Write a table of the current and recommended resources of every step.
+ * --- */
+func WriteRecommendations(w io.Writer, recommendations []datamodels.Recommendation, job datamodels.Job) {
+	memoryHeader := "MEMORY/CPU"
+	if job.IsStandaloneCommand() {
+		memoryHeader = "MEMORY"
+	}
+	fmt.Fprintf(w, "%-24s %5s %-10s %-16s %-26s %-10s %s\n", "STEP", "RUNS", "CPUS", memoryHeader, "TIME", "PEAK MEM", "CPU EFF")
+	for _, rec := range recommendations {
+		current := job.Commands[commandIndex(job, rec.Step)].Preamble
+
+		efficiency := "-"
+		if rec.CPUEfficiency > 0 {
+			efficiency = fmt.Sprintf("%.0f%%", rec.CPUEfficiency*100)
+		}
+		peak := "-"
+		if rec.PeakMemory > 0 {
+			peak = rec.PeakMemory.String()
+		}
+		fmt.Fprintf(w, "%-24s %5d %-10s %-16s %-26s %-10s %s\n",
+			rec.Step,
+			rec.Runs,
+			fmt.Sprintf("%d -> %d", current.CPUs, rec.CPUs),
+			fmt.Sprintf("%s -> %s", current.Memory, rec.Memory),
+			fmt.Sprintf("%s -> %s", formatWallTime(current.WallTime), formatWallTime(rec.WallTime)),
+			peak,
+			efficiency)
+	}
+}
+
+func commandIndex(job datamodels.Job, stepID string) int {
+	for i, cmd := range job.Commands {
+		if cmd.StepID() == stepID {
+			return i
+		}
+	}
+	return -1
+}
+
+func formatWallTime(t datamodels.WallTime) string {
+	if t == 0 {
+		return "-"
+	}
+	return t.String()
+}
+
+/* ---
+ * Write a copy of a JSON param file with the recommended cpus, memory and
+ * time set on every step that has them.
+ * --- */
+func writeTunedParams(paramFile string, writeFile string, recommendations []datamodels.Recommendation, job datamodels.Job) error {
+	rawJSON, err := ioutil.ReadFile(paramFile)
+	if err != nil {
+		return err
+	}
+	jsonParsed, err := gabs.ParseJSON(rawJSON)
+	if err != nil {
+		return err
+	}
+
+	commands := jsonParsed.Path("commands").Children()
+	for _, rec := range recommendations {
+		i := commandIndex(job, rec.Step)
+		if i < 0 || i >= len(commands) {
+			continue
+		}
+		if _, err = commands[i].Set(rec.CPUs, "cpus"); err != nil {
+			return err
+		}
+		if rec.Memory > 0 {
+			if _, err = commands[i].Set(rec.Memory.String(), "memory"); err != nil {
+				return err
+			}
+		}
+		if rec.WallTime > 0 {
+			if _, err = commands[i].Set(rec.WallTime.String(), "time"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return ioutil.WriteFile(writeFile, []byte(jsonParsed.StringIndent("", "  ")+"\n"), 0644)
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"commander/datamodels"
+	"reflect"
+	"testing"
+)
+
+func TestMatchUsageToSteps(t *testing.T) {
+	job := datamodels.Job{Commands: []datamodels.Command{
+		{ID: "fastqc", CommandParams: datamodels.CommandParams{Command: "fastqc"}},
+		{ID: "fastqc_trimmed", CommandParams: datamodels.CommandParams{Command: "fastqc"}},
+		{CommandParams: datamodels.CommandParams{Command: "samtools", Subcommand: "index"}},
+	}}
+	var tests = []struct {
+		name string
+		step string
+	}{
+		{"fastqc", "fastqc"},
+		{"fastqc_A", "fastqc"},
+		{"fastqc_A.sh", "fastqc"},
+		{"fastqc_trimmed", "fastqc_trimmed"},
+		{"fastqc_trimmed_A", "fastqc_trimmed"},
+		{"fastqc_trimmed_A.sh", "fastqc_trimmed"},
+		{"samtools_index_B", "samtools_index"},
+		{"samtools_B", ""},
+		{"fastqcA", ""},
+		{"chain1_A", ""},
+		{"test", ""},
+	}
+
+	for _, tt := range tests {
+		matched := MatchUsageToSteps([]datamodels.UsageRecord{{Name: tt.name}}, job)
+		step := ""
+		if len(matched) > 0 {
+			step = matched[0].Step
+		}
+		if step != tt.step {
+			t.Errorf("MatchUsageToSteps(%q) step = %q, want %q", tt.name, step, tt.step)
+		}
+	}
+}
+
+func TestRecommendResources(t *testing.T) {
+	current := datamodels.CommandPreamble{Tasks: 1, CPUs: 8, Memory: 4096, WallTime: 4 * 3600}
+	var tests = []struct {
+		name   string
+		runs   []datamodels.UsageRecord
+		perCPU bool
+		want   datamodels.Recommendation
+	}{
+		{
+			// 6 and 5.25 CPUs busy. 26G x 1.2 over 6 CPUs is 5325M, rounded
+			// up to 5376M. 80m x 1.5 is 2h.
+			name: "headroom over the busiest run",
+			runs: []datamodels.UsageRecord{
+				{CPUs: 8, Elapsed: 3600, CPUSeconds: 21600, MaxRSS: 26 * 1024},
+				{CPUs: 8, Elapsed: 4800, CPUSeconds: 25200, MaxRSS: 20 * 1024},
+			},
+			perCPU: true,
+			want: datamodels.Recommendation{
+				Runs: 2, CPUs: 6, Memory: 5376, WallTime: 2 * 3600,
+				PeakMemory: 26 * 1024, MaxElapsed: 4800, CPUEfficiency: 46800.0 / 67200.0,
+			},
+		},
+		{
+			// 1G x 1.2 is 1229M, rounded up to 1280M. 600s x 1.5 is exactly 15m.
+			name:   "rounded up to the next step",
+			runs:   []datamodels.UsageRecord{{CPUs: 2, Elapsed: 600, CPUSeconds: 550.5, MaxRSS: 1024}},
+			perCPU: true,
+			want: datamodels.Recommendation{
+				Runs: 1, CPUs: 1, Memory: 1280, WallTime: 15 * 60,
+				PeakMemory: 1024, MaxElapsed: 600, CPUEfficiency: 550.5 / 1200,
+			},
+		},
+		{
+			name:   "at least one CPU, one memory and one time step",
+			runs:   []datamodels.UsageRecord{{Elapsed: 100, CPUSeconds: 10, MaxRSS: 100}},
+			perCPU: true,
+			want: datamodels.Recommendation{
+				Runs: 1, CPUs: 1, Memory: 256, WallTime: 15 * 60,
+				PeakMemory: 100, MaxElapsed: 100,
+			},
+		},
+		{
+			// 26G x 1.2 is 31949M, rounded up to 32000M.
+			name:   "memory for the whole job",
+			runs:   []datamodels.UsageRecord{{CPUs: 8, Elapsed: 3600, CPUSeconds: 21600, MaxRSS: 26 * 1024}},
+			perCPU: false,
+			want: datamodels.Recommendation{
+				Runs: 1, CPUs: 6, Memory: 32000, WallTime: 90 * 60,
+				PeakMemory: 26 * 1024, MaxElapsed: 3600, CPUEfficiency: 21600.0 / 28800.0,
+			},
+		},
+		{
+			name:   "no usage keeps the current resources",
+			runs:   []datamodels.UsageRecord{{Name: "STAR_A"}},
+			perCPU: true,
+			want:   datamodels.Recommendation{Runs: 1, CPUs: 8, Memory: 4096, WallTime: 4 * 3600},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.Step = "STAR"
+			got := RecommendResources("STAR", tt.runs, current, tt.perCPU)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RecommendResources() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundUp(t *testing.T) {
+	var memoryTests = []struct {
+		memory datamodels.Memory
+		want   datamodels.Memory
+	}{
+		{1, 256},
+		{256, 256},
+		{257, 512},
+		{5325, 5376},
+	}
+	for _, tt := range memoryTests {
+		if got := roundUpMemory(tt.memory); got != tt.want {
+			t.Errorf("roundUpMemory(%d) = %d, want %d", tt.memory, got, tt.want)
+		}
+	}
+
+	var timeTests = []struct {
+		time datamodels.WallTime
+		want datamodels.WallTime
+	}{
+		{1, 15 * 60},
+		{15 * 60, 15 * 60},
+		{15*60 + 1, 30 * 60},
+		{7200, 7200},
+	}
+	for _, tt := range timeTests {
+		if got := roundUpWallTime(tt.time); got != tt.want {
+			t.Errorf("roundUpWallTime(%d) = %d, want %d", tt.time, got, tt.want)
+		}
+	}
+}